@@ -17,12 +17,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/goiiot/imq/mqtt"
 	"github.com/urfave/cli/altsrc"
-	"golang.org/x/net/context"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -41,10 +43,14 @@ func main() {
 	app.Author = author
 	app.Action = start
 	app.Flags = flags()
+	app.Commands = []cli.Command{passwdCommand()}
 	// parse toml config file
 	app.Before = altsrc.InitInputSourceWithContext(app.Flags,
 		altsrc.NewTomlSourceFromFlagFunc("config"))
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func flags() []cli.Flag {
@@ -59,15 +65,28 @@ func flags() []cli.Flag {
 }
 
 func start(c *cli.Context) error {
-	exitCtx, exit := context.WithCancel(context.Background())
+	opts := mqtt.OptionsFromContext(c)
+	srv, err := mqtt.NewServer(opts)
+	if err != nil {
+		return err
+	}
 
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, os.Interrupt, os.Kill)
-	go func() {
-		<-sigCh
-		exit()
-	}()
+	if err := srv.Start(); err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		srv.ReloadCerts()
+		srv.ReloadAuth()
+	}
 
-	mqtt.Init(exitCtx, c)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.GraceShutdownTime)
+	defer cancel()
+	srv.Shutdown(ctx)
 	return nil
 }
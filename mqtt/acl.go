@@ -0,0 +1,241 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ACLAction is the operation of client checked by Authorizer
+type ACLAction byte
+
+// acl actions
+const (
+	ACLPublish   ACLAction = 1 << iota // publish to topic name
+	ACLSubscribe                       // subscribe to topic filter
+)
+
+// Authorizer checks whether the client authenticated with info is allowed
+// to publish to topic name or subscribe to topic filter
+type Authorizer interface {
+	Authorize(info *AuthInfo, action ACLAction, topic string) bool
+}
+
+// authorize checks client operation against acl of the client and the
+// server, everything is allowed without any
+func (s *Server) authorize(info *AuthInfo, action ACLAction, topic string) bool {
+	if info.ACL != nil && !info.ACL.Authorize(info, action, topic) {
+		return false
+	}
+
+	if s.acl == nil {
+		return true
+	}
+	return s.acl.Authorize(info, action, topic)
+}
+
+var errBadACLRule = errors.New("invalid acl rule")
+
+// placeholders in acl topic filters
+const (
+	aclUsername = "%u"
+	aclClientID = "%c"
+)
+
+type aclRule struct {
+	allow    bool
+	actions  ACLAction
+	filter   string // topic filter, may contain placeholders
+	username string // rule of the user only if set
+	clientID string // rule of the client only if set
+}
+
+// ACLFile is an Authorizer of rules in acl file, rules are checked in
+// order and the first rule matched decides, operations matching no rule
+// are denied, each line of the file is
+//
+//	<allow|deny> <publish|subscribe|both> <topic filter> [user <username>|client <client id>]
+//
+// "all" is an alias of action "both", "%u" and "%c" in topic filter are
+// replaced with username and client id, empty lines and lines starting
+// with '#' are ignored
+type ACLFile struct {
+	path  string
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+// LoadACLFile loads rules from acl file
+func LoadACLFile(path string) (*ACLFile, error) {
+	f := &ACLFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads rules from the file again, rules loaded are kept if
+// the file is invalid
+func (f *ACLFile) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var rules []aclRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := parseACLRule(strings.Fields(text))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", f.path, line, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+	return nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	var rule aclRule
+	if len(fields) != 3 && len(fields) != 5 {
+		return rule, errBadACLRule
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("invalid acl permission %q", fields[0])
+	}
+
+	switch fields[1] {
+	case "publish":
+		rule.actions = ACLPublish
+	case "subscribe":
+		rule.actions = ACLSubscribe
+	case "both", "all":
+		rule.actions = ACLPublish | ACLSubscribe
+	default:
+		return rule, fmt.Errorf("invalid acl action %q", fields[1])
+	}
+
+	rule.filter = fields[2]
+	if !validTopicFilter(rule.filter) {
+		return rule, fmt.Errorf("invalid acl topic filter %q", rule.filter)
+	}
+
+	if len(fields) == 5 {
+		switch fields[3] {
+		case "user":
+			rule.username = fields[4]
+		case "client":
+			rule.clientID = fields[4]
+		default:
+			return rule, fmt.Errorf("invalid acl subject %q", fields[3])
+		}
+	}
+	return rule, nil
+}
+
+// Authorize checks the operation against rules in order
+func (f *ACLFile) Authorize(info *AuthInfo, action ACLAction, topic string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, rule := range f.rules {
+		if rule.actions&action == 0 ||
+			rule.username != "" && rule.username != info.Username ||
+			rule.clientID != "" && rule.clientID != info.ClientID {
+			continue
+		}
+
+		filter, ok := expandACLFilter(rule.filter, info)
+		if ok && aclMatch(filter, topic) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+// expandACLFilter replaces placeholders in acl topic filter, return false
+// if the placeholder has no value or the value would change topic levels
+func expandACLFilter(filter string, info *AuthInfo) (string, bool) {
+	for placeholder, value := range map[string]string{
+		aclUsername: info.Username,
+		aclClientID: info.ClientID,
+	} {
+		if strings.Contains(filter, placeholder) &&
+			(value == "" || strings.ContainsAny(value, topicSep+wildcardSingle+wildcardMulti)) {
+			return "", false
+		}
+	}
+
+	// replace in one pass, values containing placeholders are kept as is
+	return strings.NewReplacer(aclUsername, info.Username, aclClientID, info.ClientID).Replace(filter), true
+}
+
+// aclMatch reports whether acl topic filter covers topic, which is topic
+// name to publish or topic filter to subscribe
+func aclMatch(filter, topic string) bool {
+	filterLevels := strings.Split(filter, topicSep)
+	topicLevels := strings.Split(topic, topicSep)
+	if strings.HasPrefix(topic, sysTopicPrefix) &&
+		(filterLevels[0] == wildcardSingle || filterLevels[0] == wildcardMulti) {
+		// same as matching subscriptions
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == wildcardMulti {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		switch level {
+		case wildcardSingle:
+			if topicLevels[i] == wildcardMulti {
+				return false
+			}
+		case topicLevels[i]:
+		default:
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
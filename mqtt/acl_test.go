@@ -0,0 +1,173 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseACLRule(t *testing.T) {
+	cases := []struct {
+		rule    string
+		actions ACLAction
+		err     bool
+	}{
+		{"allow publish a/b", ACLPublish, false},
+		{"deny subscribe a/#", ACLSubscribe, false},
+		{"allow both a/+", ACLPublish | ACLSubscribe, false},
+		{"allow all a/+", ACLPublish | ACLSubscribe, false},
+		{"allow both a/+ user alice", ACLPublish | ACLSubscribe, false},
+		{"allow read a/b", 0, true},
+		{"permit publish a/b", 0, true},
+		{"allow publish a/#/b", 0, true},
+		{"allow publish a/b group x", 0, true},
+		{"allow publish", 0, true},
+	}
+
+	for _, c := range cases {
+		rule, err := parseACLRule(strings.Fields(c.rule))
+		if (err != nil) != c.err {
+			t.Errorf("%q: got err %v, want err %v", c.rule, err, c.err)
+			continue
+		}
+		if err == nil && rule.actions != c.actions {
+			t.Errorf("%q: got actions %v, want %v", c.rule, rule.actions, c.actions)
+		}
+	}
+}
+
+func TestExpandACLFilter(t *testing.T) {
+	cases := []struct {
+		filter   string
+		username string
+		clientID string
+		want     string
+		ok       bool
+	}{
+		{"a/%u/%c", "alice", "c1", "a/alice/c1", true},
+		{"a/%u", "", "c1", "", false},
+		{"a/%c", "alice", "", "", false},
+		{"a/b", "", "", "a/b", true},
+		{"a/%u", "a/b", "c1", "", false},
+		{"a/%c", "alice", "c+", "", false},
+		{"a/%c", "alice", "c#", "", false},
+		// values are not expanded again
+		{"a/%u/%c", "%c", "c1", "a/%c/c1", true},
+		{"a/%u/%c", "alice", "%u", "a/alice/%u", true},
+	}
+
+	for _, c := range cases {
+		got, ok := expandACLFilter(c.filter, &AuthInfo{Username: c.username, ClientID: c.clientID})
+		if got != c.want || ok != c.ok {
+			t.Errorf("%q (%q, %q): got %q, %v, want %q, %v", c.filter, c.username, c.clientID, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestACLMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+		// subscribing to wider filter than allowed
+		{"a/+", "a/#", false},
+		{"a/+", "a/+", true},
+		{"a/#", "a/+/b", true},
+	}
+
+	for _, c := range cases {
+		if got := aclMatch(c.filter, c.topic); got != c.want {
+			t.Errorf("%q, %q: got %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imq-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl")
+	rules := `# comment
+deny  publish   users/alice/secret user alice
+allow both      users/%u/#
+allow subscribe public/#
+allow all       clients/%c client c1
+`
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &AuthInfo{Username: "alice", ClientID: "c1"}
+	bob := &AuthInfo{Username: "bob", ClientID: "c2"}
+	cases := []struct {
+		name   string
+		info   *AuthInfo
+		action ACLAction
+		topic  string
+		want   bool
+	}{
+		{"own topic", alice, ACLPublish, "users/alice/x", true},
+		{"own filter", alice, ACLSubscribe, "users/alice/#", true},
+		{"denied first", alice, ACLPublish, "users/alice/secret", false},
+		{"denied other user", bob, ACLPublish, "users/bob/secret", true},
+		{"other user", bob, ACLPublish, "users/alice/x", false},
+		{"public subscribe", bob, ACLSubscribe, "public/x", true},
+		{"public publish", bob, ACLPublish, "public/x", false},
+		{"client rule", alice, ACLPublish, "clients/c1", true},
+		{"client rule other", bob, ACLPublish, "clients/c2", false},
+		{"no rule", alice, ACLPublish, "other", false},
+	}
+
+	for _, c := range cases {
+		if got := f.Authorize(c.info, c.action, c.topic); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// invalid file keeps rules loaded
+	if err := ioutil.WriteFile(path, []byte("allow none x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err == nil {
+		t.Errorf("reload invalid file: got nil err")
+	}
+	if !f.Authorize(alice, ACLPublish, "users/alice/x") {
+		t.Errorf("reload invalid file: rules loaded are dropped")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+var (
+	errBadTopicAlias     = errors.New("topic alias exceeds maximum")
+	errUnknownTopicAlias = errors.New("topic alias not mapped")
+)
+
+// resolveAlias maps the topic alias of publish packet from client to its
+// topic name, topic name and alias are both kept by the connection for
+// later packets, the alias is removed from packet before routing
+func (c *connImpl) resolveAlias(pkt *mqtt.PublishPacket) error {
+	if pkt.Props == nil || pkt.Props.TopicAlias == 0 {
+		return nil
+	}
+
+	alias := pkt.Props.TopicAlias
+	pkt.Props.TopicAlias = 0
+	if int(alias) > c.srv.opts.MaxTopicAlias {
+		return errBadTopicAlias
+	}
+
+	if pkt.TopicName != "" {
+		if c.aliasIn == nil {
+			c.aliasIn = make(map[uint16]string)
+		}
+		c.aliasIn[alias] = pkt.TopicName
+		return nil
+	}
+
+	topic, ok := c.aliasIn[alias]
+	if !ok {
+		return errUnknownTopicAlias
+	}
+	pkt.TopicName = topic
+	return nil
+}
+
+// applyAlias returns publish packet to send with topic alias if the
+// client accepts topic alias, topic name is omitted when the client
+// already knows the alias
+func (c *connImpl) applyAlias(pkt *mqtt.PublishPacket) *mqtt.PublishPacket {
+	if c.aliasOut == nil {
+		return pkt
+	}
+
+	alias, known := c.aliasOut.get(pkt.TopicName)
+
+	// message is shared by sessions and kept for retransmission
+	msg := *pkt
+	props := mqtt.PublishProps{}
+	if pkt.Props != nil {
+		props = *pkt.Props
+	}
+	props.TopicAlias = alias
+	msg.Props = &props
+	if known {
+		msg.TopicName = ""
+	}
+	return &msg
+}
+
+// aliasCache assigns topic aliases of messages sent to client, alias of
+// the least recently used topic is reassigned when all are in use
+type aliasCache struct {
+	max    int
+	topics map[string]*list.Element // topic -> element of *topicAlias
+	lru    *list.List               // most recently used at front
+}
+
+type topicAlias struct {
+	topic string
+	alias uint16
+}
+
+func newAliasCache(max uint16) *aliasCache {
+	return &aliasCache{
+		max:    int(max),
+		topics: make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// get alias of the topic, known is false if the alias is newly assigned
+// and client must be told the topic name
+func (a *aliasCache) get(topic string) (alias uint16, known bool) {
+	if e, ok := a.topics[topic]; ok {
+		a.lru.MoveToFront(e)
+		return e.Value.(*topicAlias).alias, true
+	}
+
+	var t *topicAlias
+	if a.lru.Len() < a.max {
+		t = &topicAlias{alias: uint16(a.lru.Len() + 1)}
+	} else {
+		e := a.lru.Back()
+		a.lru.Remove(e)
+		t = e.Value.(*topicAlias)
+		delete(a.topics, t.topic)
+	}
+
+	t.topic = topic
+	a.topics[topic] = a.lru.PushFront(t)
+	return t.alias, false
+}
+
+// forget the alias of topic, which is to be reassigned first
+func (a *aliasCache) forget(topic string) {
+	e, ok := a.topics[topic]
+	if !ok {
+		return
+	}
+
+	delete(a.topics, topic)
+	e.Value.(*topicAlias).topic = ""
+	a.lru.MoveToBack(e)
+}
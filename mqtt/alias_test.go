@@ -0,0 +1,114 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+func TestAliasCache(t *testing.T) {
+	a := newAliasCache(2)
+	cases := []struct {
+		op    string // get or forget
+		topic string
+		alias uint16
+		known bool
+	}{
+		{"get", "a", 1, false},
+		{"get", "b", 2, false},
+		{"get", "a", 1, true},
+		// b is the least recently used
+		{"get", "c", 2, false},
+		{"get", "b", 1, false},
+		{"get", "c", 2, true},
+		// forgotten alias is reassigned first
+		{"forget", "c", 0, false},
+		{"get", "d", 2, false},
+		{"get", "b", 1, true},
+		{"forget", "x", 0, false},
+		{"get", "e", 2, false},
+	}
+
+	for i, c := range cases {
+		if c.op == "forget" {
+			a.forget(c.topic)
+			continue
+		}
+
+		alias, known := a.get(c.topic)
+		if alias != c.alias || known != c.known {
+			t.Errorf("%d get %q: got %d, %v, want %d, %v", i, c.topic, alias, known, c.alias, c.known)
+		}
+	}
+
+	if len(a.topics) != 2 || a.lru.Len() != 2 {
+		t.Errorf("got %d topics, %d aliases, want 2, 2", len(a.topics), a.lru.Len())
+	}
+}
+
+func TestResolveAlias(t *testing.T) {
+	c := &connImpl{srv: &Server{opts: &Options{MaxTopicAlias: 2}}}
+	cases := []struct {
+		topic string
+		alias uint16
+		want  string
+		err   error
+	}{
+		{"a/b", 0, "a/b", nil},
+		{"", 1, "", errUnknownTopicAlias},
+		{"a/b", 1, "a/b", nil},
+		{"", 1, "a/b", nil},
+		{"c/d", 1, "c/d", nil},
+		{"", 1, "c/d", nil},
+		{"a/b", 3, "", errBadTopicAlias},
+	}
+
+	for i, tc := range cases {
+		pkt := &mqtt.PublishPacket{TopicName: tc.topic, Props: &mqtt.PublishProps{TopicAlias: tc.alias}}
+		err := c.resolveAlias(pkt)
+		if err != tc.err {
+			t.Errorf("%d: got %v, want %v", i, err, tc.err)
+			continue
+		}
+		if err == nil && (pkt.TopicName != tc.want || pkt.Props.TopicAlias != 0) {
+			t.Errorf("%d: got topic %q, alias %d, want %q, 0", i, pkt.TopicName, pkt.Props.TopicAlias, tc.want)
+		}
+	}
+}
+
+func TestApplyAlias(t *testing.T) {
+	c := &connImpl{}
+	pkt := &mqtt.PublishPacket{TopicName: "a/b", Payload: []byte("x")}
+	if got := c.applyAlias(pkt); got != pkt {
+		t.Errorf("alias not accepted: got %+v, want packet unchanged", got)
+	}
+
+	c.aliasOut = newAliasCache(1)
+	for i, want := range []string{"a/b", ""} {
+		got := c.applyAlias(pkt)
+		if got.TopicName != want || got.Props == nil || got.Props.TopicAlias != 1 {
+			t.Errorf("%d: got topic %q, props %+v, want %q with alias 1", i, got.TopicName, got.Props, want)
+		}
+	}
+
+	// message shared by sessions is not changed
+	if pkt.TopicName != "a/b" || pkt.Props != nil {
+		t.Errorf("got original packet changed to %+v", pkt)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrBadCredentials is returned by Authenticator if username or
+	// password is wrong, clients are refused with bad username or password
+	ErrBadCredentials = errors.New("bad username or password")
+
+	// ErrNotAuthorized is returned by Authenticator if the client is not
+	// allowed to connect, clients are refused with not authorized
+	ErrNotAuthorized = errors.New("not authorized")
+)
+
+var (
+	errBadUsername   = errors.New("username is empty or contains ':'")
+	errAuthExclusive = errors.New("password file, auth webhook and jwt auth are exclusive")
+	errACLExclusive  = errors.New("acl file and acl webhook are exclusive")
+)
+
+// AuthInfo is the identity presented by client in connect packet
+type AuthInfo struct {
+	ClientID string
+	Username string
+	Password []byte
+	Addr     net.Addr          // remote address of client
+	Cert     *x509.Certificate // verified client certificate, nil if none
+
+	// set by Authenticator if any
+	Expiry time.Time  // connection is closed when identity expires
+	ACL    Authorizer // acl of the client, checked before the one of server
+}
+
+// Authenticator checks identity of connecting clients, any error other
+// than ErrBadCredentials and ErrNotAuthorized refuses the client with
+// server unavailable, ClientID and Username of info may be replaced with
+// the identity authenticated
+type Authenticator interface {
+	Authenticate(info *AuthInfo) error
+}
+
+// initAuth creates authenticator and authorizer from options, those set
+// in options directly take precedence
+func (s *Server) initAuth() error {
+	o := s.opts
+	useJWT := o.JWTJWKSFile != "" || len(o.JWTKeyFiles) > 0 || o.JWTSecret != ""
+
+	sources := 0
+	for _, set := range []bool{o.PasswordFile != "", o.WebhookAuthURL != "", useJWT} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errAuthExclusive
+	}
+
+	if o.ACLFile != "" && o.WebhookACLURL != "" {
+		return errACLExclusive
+	}
+
+	hook := &Webhook{
+		AuthURL:  o.WebhookAuthURL,
+		ACLURL:   o.WebhookACLURL,
+		Timeout:  o.WebhookTimeout,
+		AllowTTL: o.WebhookAllowTTL,
+		DenyTTL:  o.WebhookDenyTTL,
+		FailOpen: o.WebhookFailOpen,
+		Logger:   s.log,
+	}
+
+	switch {
+	case o.Authenticator != nil:
+		s.auth = o.Authenticator
+	case o.PasswordFile != "":
+		f, err := LoadPasswordFile(o.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("load password file failed, error = %s", err.Error())
+		}
+		s.auth = f
+	case o.WebhookAuthURL != "":
+		s.auth = hook
+	case useJWT:
+		a, err := LoadJWTAuth(o.JWTJWKSFile, o.JWTKeyFiles, []byte(o.JWTSecret))
+		if err != nil {
+			return fmt.Errorf("load jwt keys failed, error = %s", err.Error())
+		}
+		a.Audience = o.JWTAudience
+		a.ClientIDClaim = o.JWTClientIDClaim
+		a.UsernameClaim = o.JWTUsernameClaim
+		a.PublishClaim = o.JWTPublishClaim
+		a.SubscribeClaim = o.JWTSubscribeClaim
+		s.auth = a
+	}
+
+	switch {
+	case o.Authorizer != nil:
+		s.acl = o.Authorizer
+	case o.ACLFile != "":
+		f, err := LoadACLFile(o.ACLFile)
+		if err != nil {
+			return fmt.Errorf("load acl file failed, error = %s", err.Error())
+		}
+		s.acl = f
+	case o.WebhookACLURL != "":
+		s.acl = hook
+	}
+
+	s.initAuthMethods()
+	return nil
+}
+
+// authenticate checks client identity, every client is accepted without
+// authenticator, clients without username and password are anonymous and
+// only accepted with AllowAnonymous, clients with username taken from
+// verified certificate are not passed to the authenticator
+func (s *Server) authenticate(info *AuthInfo, certUser bool) error {
+	if certUser || s.auth == nil {
+		return nil
+	}
+
+	if info.Username == "" && len(info.Password) == 0 {
+		if s.opts.AllowAnonymous {
+			return nil
+		}
+		return ErrNotAuthorized
+	}
+	return s.auth.Authenticate(info)
+}
+
+// reloader is implemented by authenticators and authorizers backed by
+// files or other sources which can be reloaded at runtime
+type reloader interface {
+	Reload() error
+}
+
+// ReloadAuth reloads users and acl rules of built in authenticator and
+// authorizer, or those set in options implementing Reload() error
+func (s *Server) ReloadAuth() {
+	for _, r := range []interface{}{s.auth, s.acl} {
+		if r, ok := r.(reloader); ok {
+			if err := r.Reload(); err != nil {
+				s.log.Error("reload auth failed", zap.Error(err))
+				continue
+			}
+			s.log.Info("auth reloaded", zap.String("provider", fmt.Sprintf("%T", r)))
+		}
+	}
+}
+
+// authCode converts error of authenticator to connack reason code
+func authCode(err error) byte {
+	switch err {
+	case nil:
+		return mqtt.CodeSuccess
+	case ErrBadCredentials, errBadSCRAMMessage:
+		return mqtt.CodeBadUserPass
+	case ErrNotAuthorized, errAuthUserChange:
+		return mqtt.CodeNotAuthorized
+	case errBadAuthMethod:
+		return mqtt.CodeBadAuthenticationMethod
+	case errUnexpectedPacket, errAuthMethodChange:
+		return mqtt.CodeProtoError
+	default:
+		return mqtt.CodeServerUnavail
+	}
+}
+
+// PasswordFile is an Authenticator of users in password file, each line
+// of the file is "<username>:<password hash>", empty lines and lines
+// starting with '#' are ignored
+type PasswordFile struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]string // username -> password hash
+}
+
+// NewPasswordFile creates empty password file to be saved at path
+func NewPasswordFile(path string) *PasswordFile {
+	return &PasswordFile{path: path, users: make(map[string]string)}
+}
+
+// LoadPasswordFile loads users from password file
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	f := NewPasswordFile(path)
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads users from the file again, users loaded are kept if
+// the file is invalid
+func (f *PasswordFile) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(text, ':')
+		if i <= 0 || i == len(text)-1 {
+			return fmt.Errorf("%s:%d: invalid password entry", f.path, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.mu.Unlock()
+	return nil
+}
+
+// dummyHash is verified for unknown users, so that they take as long as
+// users with hash of default method and can't be told from them
+const dummyHash = "$pbkdf2-sha256$i=100000$aW1xLWR1bW15LXNhbHQxNg$wF+c8B+wbEAdwgJabookfZ6v3ibxnXpcYF4p3F9UVNw"
+
+// Authenticate checks password of the user against its hash
+func (f *PasswordFile) Authenticate(info *AuthInfo) error {
+	f.mu.RLock()
+	hash, ok := f.users[info.Username]
+	f.mu.RUnlock()
+
+	if !ok {
+		verifyPassword(dummyHash, info.Password)
+		return ErrBadCredentials
+	}
+
+	match, err := verifyPassword(hash, info.Password)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// LookupSCRAM implements SCRAMStore with users of pbkdf2-sha256 hash,
+// which is the salted password of SCRAM-SHA-256
+func (f *PasswordFile) LookupSCRAM(username string) (*SCRAMCredentials, error) {
+	f.mu.RLock()
+	hash, ok := f.users[username]
+	f.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	iter, salt, key, err := parsePBKDF2(hash)
+	if err != nil || len(key) != sha256.Size {
+		// hashed with other methods
+		return nil, ErrBadCredentials
+	}
+	return newSCRAMCredentials(salt, iter, key), nil
+}
+
+// Set adds the user or changes its password, password is hashed with
+// the hash method
+func (f *PasswordFile) Set(username string, password []byte, method string) error {
+	if username == "" || strings.ContainsRune(username, ':') {
+		return errBadUsername
+	}
+
+	hash, err := HashPassword(method, password)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.users[username] = hash
+	f.mu.Unlock()
+	return nil
+}
+
+// Remove deletes the user, return false if the user does not exist
+func (f *PasswordFile) Remove(username string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.users[username]
+	delete(f.users, username)
+	return ok
+}
+
+// Save writes all users to the file, replacing it atomically
+func (f *PasswordFile) Save() error {
+	f.mu.RLock()
+	users := make([]string, 0, len(f.users))
+	for user := range f.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	buf := &bytes.Buffer{}
+	for _, user := range users {
+		fmt.Fprintf(buf, "%s:%s\n", user, f.users[user])
+	}
+	f.mu.RUnlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
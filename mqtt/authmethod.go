@@ -0,0 +1,179 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// time allowed for client to answer each auth challenge
+const authTimeout = 10 * time.Second
+
+var (
+	errBadAuthMethod    = errors.New("unsupported authentication method")
+	errAuthNotStarted   = errors.New("auth packet without authentication in progress")
+	errAuthMethodChange = errors.New("authentication method changed")
+	errAuthUserChange   = errors.New("username changed by re-authentication")
+	errUnexpectedPacket = errors.New("unexpected packet during authentication")
+)
+
+// AuthMethod is a method of mqtt 5 enhanced authentication, which
+// creates an exchange for each authentication and re-authentication
+type AuthMethod interface {
+	NewExchange(info *AuthInfo) AuthExchange
+}
+
+// AuthExchange is the challenge and response of one authentication
+type AuthExchange interface {
+	// Next handles auth data from client and returns auth data to send,
+	// done is true if the client is authenticated, Username of info
+	// passed to NewExchange may be set before that, any error other than
+	// ErrBadCredentials and ErrNotAuthorized is handled as server
+	// unavailable
+	Next(data []byte) (resp []byte, done bool, err error)
+}
+
+// initAuthMethods registers enhanced authentication methods set in
+// options and built in methods backed by the authenticator
+func (s *Server) initAuthMethods() {
+	s.authMethods = make(map[string]AuthMethod)
+	if store, ok := s.auth.(SCRAMStore); ok {
+		s.authMethods[AuthMethodSCRAMSHA256] = &SCRAMSHA256{Store: store}
+	}
+
+	for name, method := range s.opts.AuthMethods {
+		s.authMethods[name] = method
+	}
+}
+
+// authMethod returns enhanced authentication method of the connection,
+// empty if the client authenticated with username and password
+func (c *connImpl) authMethod() string {
+	if c.connPkt.Props == nil {
+		return ""
+	}
+	return c.connPkt.Props.AuthMethod
+}
+
+// enhancedAuth runs the authentication exchange of connect packet with
+// auth packets before connack is sent, return auth data for connack
+func (c *connImpl) enhancedAuth(info *AuthInfo) ([]byte, error) {
+	name := c.authMethod()
+	method, ok := c.srv.authMethods[name]
+	if !ok {
+		return nil, errBadAuthMethod
+	}
+
+	exchange := method.NewExchange(info)
+	data := c.connPkt.Props.AuthData
+	for {
+		resp, done, err := exchange.Next(data)
+		if err != nil || done {
+			return resp, err
+		}
+
+		err = c.write(&mqtt.AuthPacket{
+			Code:  mqtt.CodeContinueAuth,
+			Props: &mqtt.AuthProps{AuthMethod: name, AuthData: resp},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(authTimeout))
+		pkt, err := readPacket(c.version, c.connRW.Reader, c.srv.opts.MaxPacketSize)
+		c.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+
+		auth, ok := pkt.(*mqtt.AuthPacket)
+		if !ok || auth.Code != mqtt.CodeContinueAuth {
+			return nil, errUnexpectedPacket
+		}
+
+		if auth.Props.AuthMethod != name {
+			return nil, errAuthMethodChange
+		}
+		data = auth.Props.AuthData
+	}
+}
+
+// handleAuth handles auth packets of re-authentication, which may be
+// interleaved with other packets, return false if the connection should
+// be closed
+func (c *connImpl) handleAuth(pkt *mqtt.AuthPacket) bool {
+	method := c.authMethod()
+
+	var err error
+	switch {
+	case method == "":
+		err = errAuthNotStarted
+	case pkt.Props.AuthMethod != method:
+		err = errAuthMethodChange
+	case pkt.Code == mqtt.CodeReAuth:
+		c.reAuthInfo = &AuthInfo{
+			ClientID: c.authInfo.ClientID,
+			Username: c.authInfo.Username,
+			Addr:     c.authInfo.Addr,
+			Cert:     c.authInfo.Cert,
+		}
+		c.reAuth = c.srv.authMethods[method].NewExchange(c.reAuthInfo)
+	case pkt.Code != mqtt.CodeContinueAuth || c.reAuth == nil:
+		err = errAuthNotStarted
+	}
+
+	if err != nil {
+		c.srv.log.Error("invalid auth packet", zap.String("client", c.clientID), zap.Error(err))
+		c.disconnect(mqtt.CodeProtoError, err.Error())
+		return false
+	}
+
+	resp, done, err := c.reAuth.Next(pkt.Props.AuthData)
+	if err == nil && done && c.reAuthInfo.Username != c.authInfo.Username {
+		err = errAuthUserChange
+	}
+
+	if err != nil {
+		c.srv.log.Info("re-authentication failed", zap.String("client", c.clientID), zap.Error(err))
+		c.reAuth = nil
+		code := authCode(err)
+		if code == mqtt.CodeBadUserPass {
+			// not a reason code of disconnect
+			code = mqtt.CodeNotAuthorized
+		}
+		c.disconnect(code, err.Error())
+		return false
+	}
+
+	code := byte(mqtt.CodeContinueAuth)
+	if done {
+		c.srv.log.Debug("client re-authenticated", zap.String("client", c.clientID))
+		c.reAuth = nil
+		code = mqtt.CodeSuccess
+	}
+
+	c.send(&mqtt.AuthPacket{
+		Code:  code,
+		Props: &mqtt.AuthProps{AuthMethod: method, AuthData: resp},
+	})
+	return true
+}
@@ -18,192 +18,429 @@ package mqtt
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	mqtt "github.com/goiiot/libmqtt"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
-	"gopkg.in/urfave/cli.v1"
+	"go.uber.org/zap/zapcore"
 )
 
-var (
+// Server is the mqtt broker, each server has its own sessions,
+// subscriptions and retained messages, so that multiple servers
+// can run in one process
+type Server struct {
+	opts *Options
 	log  *zap.Logger
-	conf *config
-	wg   = &sync.WaitGroup{}
-)
+	wg   sync.WaitGroup
+
+	persist     mqtt.PersistMethod // persist method used to save session state
+	sessions    *sessionStore
+	subs        *subTree
+	retained    *retainTree
+	certs       *certStore // server certificates shared by tcps and wss services
+	auth        Authenticator
+	acl         Authorizer
+	authMethods map[string]AuthMethod // enhanced authentication methods (mqtt 5)
+	upGrader    *websocket.Upgrader
+
+	// connection limiters of all listeners and each listener
+	connLimit *limiter
+	tcpLimit  *limiter
+	tcpsLimit *limiter
+	wsLimit   *limiter
+	wssLimit  *limiter
+	refusing  chan struct{} // slots of refused connections being answered
 
-var (
 	tcpService  net.Listener
 	tcpsService net.Listener
 	wsService   *http.Server
 	wssService  *http.Server
-)
 
-// Init mqtt service
-func Init(exit context.Context, context *cli.Context) {
-	var err error
-	log, err = zap.NewDevelopment()
-	if err != nil {
-		panic(fmt.Sprintf("create mqtt logger failed, error = %s", err.Error()))
+	// connections accepted and not yet torn down, including those
+	// still in handshake, they are closed by Shutdown
+	connMu  sync.Mutex
+	conns   map[net.Conn]struct{}
+	connWG  sync.WaitGroup
+	closing bool // no more connection is accepted
+
+	exit context.CancelFunc // stops background workers
+}
+
+// NewServer creates mqtt server with options, call Start to serve clients
+func NewServer(opts *Options) (*Server, error) {
+	o := *opts
+	if o.Version == 0 {
+		o.Version = mqtt.V5
+	}
+	if len(o.WSPaths) == 0 {
+		o.WSPaths = []string{"/mqtt"}
+	}
+	if o.TLSClientAuth == "" {
+		o.TLSClientAuth = ClientAuthNone
+	}
+	if o.PersistMethod == "" {
+		o.PersistMethod = "none"
+	}
+	if o.ReceiveMax <= 0 || o.ReceiveMax > maxInflight {
+		o.ReceiveMax = maxInflight
+	}
+	if o.MaxPacketSize < 0 || o.MaxPacketSize > maxPacketSize {
+		o.MaxPacketSize = 0
+	}
+	if o.MaxTopicAlias > math.MaxUint16 {
+		o.MaxTopicAlias = math.MaxUint16
+	} else if o.MaxTopicAlias < 0 {
+		o.MaxTopicAlias = 0
 	}
 
-	conf = getConfig(context)
+	log := o.Logger
+	if log == nil {
+		var err error
+		log, err = newLogger(o.LogLevel, o.LogDir)
+		if err != nil {
+			return nil, fmt.Errorf("create mqtt logger failed, error = %s", err.Error())
+		}
+		o.Logger = log
+	}
 
-	if conf.tcpPort > 0 {
-		wg.Add(1)
-		go initTCPListen()
+	s := &Server{
+		opts:  &o,
+		log:   log,
+		subs:  newSubTree(),
+		certs: &certStore{log: log},
+		conns: make(map[net.Conn]struct{}),
+		exit:  func() {},
 	}
+	s.sessions = newSessionStore(s)
+	s.retained = newRetainTree(s)
 
-	if conf.tcpsPort > 0 {
-		wg.Add(1)
-		go initTCPSListen()
+	s.persist = o.Persist
+	if s.persist == nil {
+		var err error
+		s.persist, err = initPersist(s.opts)
+		if err != nil {
+			return nil, fmt.Errorf("init persist method %q failed, error = %s", o.PersistMethod, err.Error())
+		}
 	}
 
-	if conf.wsPort > 0 {
-		wg.Add(1)
-		go initWSListen()
+	if err := s.initAuth(); err != nil {
+		return nil, err
 	}
 
-	if conf.wssPort > 0 {
-		wg.Add(1)
-		go initWSSListen()
+	s.initLimits()
+	s.initWS()
+	return s, nil
+}
+
+// newLogger creates logger writing to stderr, and also to mqtt.log
+// in dir if set, it logs to stderr only with a warning when the log
+// file can't be written
+func newLogger(level zapcore.Level, dir string) (*zap.Logger, error) {
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	if dir == "" {
+		return cfg.Build()
 	}
 
-	wg.Add(1)
+	file := filepath.Join(dir, "mqtt.log")
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		fileCfg := cfg
+		fileCfg.OutputPaths = []string{"stderr", file}
+		fileCfg.ErrorOutputPaths = []string{"stderr", file}
+
+		var log *zap.Logger
+		if log, err = fileCfg.Build(); err == nil {
+			return log, nil
+		}
+	}
+
+	log, buildErr := cfg.Build()
+	if buildErr != nil {
+		return nil, buildErr
+	}
+	log.Warn("log file not writable, logging to stderr only", zap.String("file", file), zap.Error(err))
+	return log, nil
+}
+
+// Start loads persisted state and starts all configured services, it
+// returns once they are listening, services already started are stopped
+// if any of them fails
+func (s *Server) Start() error {
+	ctx, exit := context.WithCancel(context.Background())
+	s.exit = exit
+
+	s.sessions.load()
+	s.retained.load()
+
+	if s.opts.TCPSPort > 0 || s.opts.WSSPort > 0 {
+		if err := s.initCerts(ctx); err != nil {
+			s.exit()
+			return fmt.Errorf("load tls certificates failed, error = %s", err.Error())
+		}
+	}
+
+	services := []struct {
+		port   int
+		listen func() error
+	}{
+		{s.opts.TCPPort, s.initTCPListen},
+		{s.opts.TCPSPort, s.initTCPSListen},
+		{s.opts.WSPort, s.initWSListen},
+		{s.opts.WSSPort, s.initWSSListen},
+	}
+
+	for _, service := range services {
+		if service.port <= 0 {
+			continue
+		}
+
+		if err := service.listen(); err != nil {
+			s.stopListen(context.Background())
+			s.exit()
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections, disconnects all clients with
+// server shutting down and flushes session state, connections still
+// in handshake and clients not disconnected before ctx is done are
+// closed without disconnect packet
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.log.Info("exiting mqtt services")
+	s.stopListen(ctx)
+
+	done := make(chan struct{})
 	go func() {
-		<-exit.Done()
-		log.Info("exiting mqtt services")
-		destroy(10 * time.Second)
-		wg.Done()
+		s.disconnectAll(mqtt.CodeServerShuttingDown, "server shutting down")
+		close(done)
 	}()
 
-	wg.Wait()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.log.Warn("grace shutdown time exceeded, closing remaining connections")
+	}
+
+	s.closeConns()
+	s.sessions.stopTimers()
+	s.closePersist()
+	s.exit()
+	s.wg.Wait()
+	return err
 }
 
-func destroy(timeout time.Duration) {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+// stopListen closes all listeners to stop accepting connections
+func (s *Server) stopListen(ctx context.Context) {
+	if s.tcpService != nil {
+		s.tcpService.Close()
+	}
 
-	if tcpService != nil {
-		tcpService.Close()
+	if s.tcpsService != nil {
+		s.tcpsService.Close()
 	}
 
-	if tcpsService != nil {
-		tcpsService.Close()
+	if s.wsService != nil {
+		s.wsService.Shutdown(ctx)
 	}
 
-	if wsService != nil {
-		wg.Add(1)
-		go wsService.Shutdown(ctx)
+	if s.wssService != nil {
+		s.wssService.Shutdown(ctx)
 	}
+}
 
-	if wssService != nil {
+// disconnectAll disconnects all clients connected concurrently
+func (s *Server) disconnectAll(code byte, reason string) {
+	conns := s.sessions.conns()
+	s.log.Info("disconnecting clients", zap.Int("count", len(conns)))
+
+	wg := &sync.WaitGroup{}
+	for _, c := range conns {
 		wg.Add(1)
-		go wssService.Shutdown(ctx)
+		go func(c *connImpl) {
+			defer wg.Done()
+			c.disconnect(code, reason)
+		}(c)
 	}
+	wg.Wait()
 }
 
-func initTCPListen() {
-	defer wg.Done()
+// track the connection until untrack is called after its teardown,
+// return false if server is shutting down and the connection must
+// be closed
+func (s *Server) track(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
 
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", conf.listen, conf.tcpPort))
-	if err != nil {
-		panic(err)
+	if s.closing {
+		return false
 	}
+	s.conns[conn] = struct{}{}
+	s.connWG.Add(1)
+	return true
+}
 
-	tcpService, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		panic(err)
-	}
+func (s *Server) untrack(conn net.Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
 
-	log.Debug("tcp service listening")
-	for {
-		conn, err := tcpService.Accept()
-		if err != nil {
-			log.Error("accept tcp connection failed", zap.Error(err))
-			continue
-		}
-		log.Debug("accepted tcp connection")
-		go handleConn(conn)
+	if _, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		s.connWG.Done()
 	}
 }
 
-func initTCPSListen() {
-	defer wg.Done()
+// closeConns closes all tracked connections and waits for their
+// teardown, so that session state is saved before persist closed
+func (s *Server) closeConns() {
+	s.connMu.Lock()
+	s.closing = true
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.connMu.Unlock()
+
+	if len(conns) > 0 {
+		s.log.Info("closing connections", zap.Int("count", len(conns)))
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(disconnectTimeout):
+		s.log.Warn("connections not torn down in time")
+	}
+}
 
-	cert, err := tls.LoadX509KeyPair(conf.tlsCertFile, conf.tlsKeyFile)
+func (s *Server) initTCPListen() error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.opts.Listen, s.opts.TCPPort))
 	if err != nil {
-		log.Fatal("load x509 key pair for tcps failed", zap.Error(err))
+		return fmt.Errorf("tcp listen failed, error = %s", err.Error())
 	}
+	s.tcpService = l
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		Rand:         rand.Reader,
+	s.log.Debug("tcp service listening")
+	s.wg.Add(1)
+	go s.serve(l, "tcp", s.tcpLimit)
+	return nil
+}
+
+func (s *Server) initTCPSListen() error {
+	config, err := s.tlsConfig()
+	if err != nil {
+		return fmt.Errorf("load tls config for tcps failed, error = %s", err.Error())
 	}
 
-	tcpsService, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", conf.listen, conf.tcpsPort), config)
+	l, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", s.opts.Listen, s.opts.TCPSPort), config)
 	if err != nil {
-		log.Fatal("tcps listen failed", zap.Error(err))
+		return fmt.Errorf("tcps listen failed, error = %s", err.Error())
 	}
+	s.tcpsService = l
+
+	s.log.Debug("tcps service listening")
+	s.wg.Add(1)
+	go s.serve(l, "tcps", s.tcpsLimit)
+	return nil
+}
+
+// delay before accepting again after accept failed
+const acceptRetryDelay = 100 * time.Millisecond
+
+// serve connections accepted by the listener until it's closed
+func (s *Server) serve(l net.Listener, name string, limit *limiter) {
+	defer s.wg.Done()
 
-	log.Debug("tcps service listening")
 	for {
-		conn, err := tcpsService.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Error("accept tcps connection failed", zap.Error(err))
+			if errors.Is(err, net.ErrClosed) {
+				s.log.Debug("service stopped", zap.String("listener", name))
+				return
+			}
+
+			s.log.Error("accept connection failed", zap.String("listener", name), zap.Error(err))
+			time.Sleep(acceptRetryDelay)
 			continue
 		}
-		log.Debug("accepted tcps connection", zap.String("addr", conn.RemoteAddr().String()))
-		go handleConn(conn)
-	}
 
+		s.log.Debug("accepted connection", zap.String("listener", name), zap.String("addr", conn.RemoteAddr().String()))
+		if !limit.acquire() {
+			s.refuse(conn)
+			continue
+		}
+		go s.handleConn(limit.limit(conn))
+	}
 }
 
-func initWSListen() {
-	defer wg.Done()
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mqtt", handleWS)
-
-	wsService := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", conf.listen, conf.wsPort),
-		Handler: mux,
+func (s *Server) initWSListen() error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.opts.Listen, s.opts.WSPort))
+	if err != nil {
+		return fmt.Errorf("ws listen failed, error = %s", err.Error())
 	}
 
-	log.Debug("ws service listening")
-	err := wsService.ListenAndServe()
-	if err != http.ErrServerClosed {
-		log.Error("wss service unexpectedly exited", zap.Error(err))
+	s.wsService = &http.Server{
+		Handler: s.wsMux(s.wsLimit),
 	}
-}
 
-func initWSSListen() {
-	defer wg.Done()
+	s.log.Debug("ws service listening")
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.wsService.Serve(l)
+		if err != http.ErrServerClosed {
+			s.log.Error("ws service unexpectedly exited", zap.Error(err))
+		}
+	}()
+	return nil
+}
 
-	cert, err := tls.LoadX509KeyPair(conf.tlsCertFile, conf.tlsKeyFile)
+func (s *Server) initWSSListen() error {
+	config, err := s.tlsConfig()
 	if err != nil {
-		log.Fatal("load x509 key pair for tcps failed", zap.Error(err))
+		return fmt.Errorf("load tls config for wss failed, error = %s", err.Error())
 	}
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		Rand:         rand.Reader,
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.opts.Listen, s.opts.WSSPort))
+	if err != nil {
+		return fmt.Errorf("wss listen failed, error = %s", err.Error())
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mqtt", handleWS)
-	wssService := &http.Server{
-		Addr:      fmt.Sprintf("%s:%d", conf.listen, conf.wssPort),
+	s.wssService = &http.Server{
 		TLSConfig: config,
-		Handler:   mux,
+		Handler:   s.wsMux(s.wssLimit),
 	}
 
-	log.Debug("wss service listening")
-	err = wssService.ListenAndServe()
-	if err != http.ErrServerClosed {
-		log.Error("wss service unexpectedly exited", zap.Error(err))
-	}
+	s.log.Debug("wss service listening")
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.wssService.ServeTLS(l, "", "")
+		if err != http.ErrServerClosed {
+			s.log.Error("wss service unexpectedly exited", zap.Error(err))
+		}
+	}()
+	return nil
 }
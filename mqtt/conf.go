@@ -22,13 +22,14 @@ import (
 
 	"github.com/goiiot/imq/util"
 	"github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/urfave/cli.v1"
 )
 
 // service config
 const (
-	cfgVersion    = "mqtt-service.mqtt_version"
+	cfgVersion    = "mqtt-service.version"
 	cfgCompatible = "mqtt-service.compatible"
 	cfgListen     = "mqtt-service.listen"
 	cfgTcpPort    = "mqtt-service.tcp"
@@ -39,9 +40,59 @@ const (
 	cfgTcpsMax    = "mqtt-service.max_tcps"
 	cfgWsMax      = "mqtt-service.max_ws"
 	cfgWssMax     = "mqtt-service.max_wss"
+	cfgConnMax    = "mqtt-service.max_conn"
 	cfgTlsCert    = "mqtt-service.tls_cert"
 	cfgTlsKey     = "mqtt-service.tls_key"
+	cfgTlsCA      = "mqtt-service.tls_ca"
+	cfgTlsSNICert = "mqtt-service.tls_sni_certs"
+	cfgTlsSNIKey  = "mqtt-service.tls_sni_keys"
+	cfgTlsReload  = "mqtt-service.tls_reload_interval"
+	cfgTlsAuth    = "mqtt-service.tls_client_auth"
+	cfgCertUser   = "mqtt-service.tls_cert_username"
+	cfgCertID     = "mqtt-service.tls_cert_client_id"
 	cfgGraceTime  = "mqtt-service.grace_shutdown_time"
+	cfgKeepalive  = "mqtt-service.keepalive"
+	cfgTopicAlias = "mqtt-service.max_topic_alias"
+	cfgRecvMax    = "mqtt-service.receive_max"
+	cfgPacketMax  = "mqtt-service.max_packet_size"
+	cfgWsPath     = "mqtt-service.ws_path"
+	cfgWsOrigins  = "mqtt-service.ws_origins"
+	cfgWsCompress = "mqtt-service.ws_compression"
+	cfgWsReadBuf  = "mqtt-service.ws_read_buffer"
+	cfgWsWriteBuf = "mqtt-service.ws_write_buffer"
+)
+
+// auth config
+const (
+	cfgAllowAnonymous = "mqtt-auth.allow_anonymous"
+	cfgPasswordFile   = "mqtt-auth.password_file"
+	cfgACLFile        = "mqtt-auth.acl_file"
+	cfgHookAuthURL    = "mqtt-auth.webhook_auth_url"
+	cfgHookACLURL     = "mqtt-auth.webhook_acl_url"
+	cfgHookTimeout    = "mqtt-auth.webhook_timeout"
+	cfgHookAllowTTL   = "mqtt-auth.webhook_allow_ttl"
+	cfgHookDenyTTL    = "mqtt-auth.webhook_deny_ttl"
+	cfgHookFailOpen   = "mqtt-auth.webhook_fail_open"
+	cfgJWTJWKS        = "mqtt-auth.jwt_jwks_file"
+	cfgJWTKeys        = "mqtt-auth.jwt_key_files"
+	cfgJWTSecret      = "mqtt-auth.jwt_hmac_secret"
+	cfgJWTAud         = "mqtt-auth.jwt_audience"
+	cfgJWTIDClaim     = "mqtt-auth.jwt_client_id_claim"
+	cfgJWTUserClaim   = "mqtt-auth.jwt_username_claim"
+	cfgJWTPubClaim    = "mqtt-auth.jwt_publish_claim"
+	cfgJWTSubClaim    = "mqtt-auth.jwt_subscribe_claim"
+)
+
+// default values of keys with deprecated aliases
+const (
+	defaultVersion             = "5"
+	defaultFilePersistInterval = time.Minute
+)
+
+// deprecated config keys, read only when the new key is left as default
+const (
+	cfgVersionDeprecated             = "mqtt-service.mqtt_version"
+	cfgFilePersistIntervalDeprecated = "mqtt-persist.interval"
 )
 
 // log config
@@ -53,15 +104,17 @@ const (
 // persist config
 const (
 	// common persist config
-	cfgPersistMethod           = "mqtt-persist.method"
-	cfgPersistMaxCount         = "mqtt-persist.max_count"
-	cfgPersistDropOnExceed     = "mqtt-persist.drop_on_exceed"
-	cfgPersistDuplicateReplace = "mqtt-persist.duplicate_replace"
+	cfgPersistMethod       = "mqtt-persist.method"
+	cfgPersistMaxCount     = "mqtt-persist.max_count"
+	cfgPersistDropOnExceed = "mqtt-persist.drop_on_exceed"
 
 	// file persist config
-	cfgFilePersistInterval = "mqtt-persist.interval"
+	cfgFilePersistInterval = "mqtt-persist.file_interval"
 	cfgFilePersistDir      = "mqtt-persist.file_path"
 
+	// boltdb persist config
+	cfgBoltPersistFile = "mqtt-persist.bolt_file"
+
 	// redis persist config
 	cfgRedisAddr = "mqtt-persist.redis_addr"
 	cfgRedisAuth = "mqtt-persist.redis_auth"
@@ -71,42 +124,106 @@ const (
 	cfgEtcdAddr = "mqtt-persist.etcd_addr"
 )
 
-type config struct {
+// Options of mqtt server, zero value of ports disables the service
+type Options struct {
+	// Logger used by server, created with LogLevel and LogDir if nil
+	Logger *zap.Logger
+
 	// service config
-	version                            libmqtt.ProtoVersion
-	compatible                         bool
-	listen, tlsCertFile, tlsKeyFile    string
-	tcpPort, tcpsPort, wsPort, wssPort int
-	maxTcp, maxTcps, maxWs, maxWss     int
-	graceShutdownTime                  time.Duration
+	Version                            libmqtt.ProtoVersion // max supported version, V5 if not set
+	Compatible                         bool                 // accept mqtt 3.1.1 clients when Version is V5
+	Listen                             string
+	TCPPort, TCPSPort, WSPort, WSSPort int
+	MaxTCP, MaxTCPS, MaxWS, MaxWSS     int // max connections of each port, 0 for no limit
+	MaxConn                            int // max connections of all ports, 0 for no limit
+	GraceShutdownTime                  time.Duration
+	Keepalive                          int // server keepalive for mqtt 5 clients, 0 to follow clients
+	MaxTopicAlias                      int // topic aliases accepted from mqtt 5 clients, 0 to disable
+	ReceiveMax                         int // qos 1 and qos 2 messages inflight from each mqtt 5 client, 65535 if not set
+	MaxPacketSize                      int // max size in bytes of packets from clients, 0 for no limit
+
+	// tls config
+	TLSCertFile, TLSKeyFile string
+	TLSSNICerts, TLSSNIKeys []string      // additional certs selected by server name
+	TLSReloadInterval       time.Duration // interval to check cert files for change, 0 to disable
+	TLSCAFile               string        // ca bundle to verify client certs
+	TLSClientAuth           string        // ClientAuthNone, ClientAuthOptional or ClientAuthRequired
+	TLSCertUsername         string        // CertFieldCN, CertFieldSAN or "" to keep username of client
+	TLSCertClientID         string        // CertFieldCN, CertFieldSAN or "" to keep client id of client
+
+	// websocket config
+	WSPaths                     []string // endpoint paths, "/mqtt" if not set
+	WSOrigins                   []string // allowed origins, "*" for all, same origin only if not set
+	WSCompression               bool
+	WSReadBuffer, WSWriteBuffer int
+
+	// Authenticator used directly, PasswordFile is ignored when set
+	Authenticator Authenticator
+
+	// Authorizer used directly, ACLFile is ignored when set
+	Authorizer Authorizer
 
-	// log config
-	logLevel zapcore.Level
-	logDir   string
+	// AuthMethods of mqtt 5 enhanced authentication by method name, in
+	// addition to SCRAM-SHA-256 supported with password file
+	AuthMethods map[string]AuthMethod
+
+	// auth config
+	AllowAnonymous bool   // accept clients without username and password when authenticator is set
+	PasswordFile   string // password file of users, any user is accepted if not set
+	ACLFile        string // acl file of topic rules, everything is allowed if not set
+
+	// webhook auth config, see Webhook
+	WebhookAuthURL  string // exclusive with PasswordFile and jwt auth
+	WebhookACLURL   string // exclusive with ACLFile
+	WebhookTimeout  time.Duration
+	WebhookAllowTTL time.Duration
+	WebhookDenyTTL  time.Duration
+	WebhookFailOpen bool
+
+	// jwt auth config, see JWTAuth, enabled if any key is set
+	JWTJWKSFile       string
+	JWTKeyFiles       []string // pem encoded public keys or certificates
+	JWTSecret         string   // key of HS256
+	JWTAudience       string
+	JWTClientIDClaim  string
+	JWTUsernameClaim  string
+	JWTPublishClaim   string
+	JWTSubscribeClaim string
+
+	// log config, used when Logger is nil
+	LogLevel zapcore.Level
+	LogDir   string // also log to file in the directory if set
+
+	// Persist method used directly, PersistMethod is ignored when set,
+	// it must replace packet stored with the same key
+	Persist libmqtt.PersistMethod
 
 	// persist common config
-	persistMethod           string
-	persistMaxCount         int
-	persistDropOnExceed     bool
-	persistDuplicateReplace bool
+	PersistMethod       string // "none" if not set
+	PersistMaxCount     int
+	PersistDropOnExceed bool
 
 	// file persist config
-	filePersistInterval time.Duration
-	filePersistDir      string
+	FilePersistInterval time.Duration
+	FilePersistDir      string
+
+	// boltdb persist config
+	BoltPersistFile string
 
 	// redis persist config
-	redisAddr string
-	redisAuth string
-	redisDB   int
+	RedisAddr string
+	RedisAuth string
+	RedisDB   int
 
 	// etcd persist config
-	etcdAddr string
+	EtcdAddr string
 }
 
 func Flags() []cli.Flag {
 	return []cli.Flag{
 		// service config
-		util.StringFlag(cfgVersion, "5", ""),
+		util.StringFlag(cfgVersion, defaultVersion, ""),
+		util.StringFlag(cfgVersionDeprecated, "", "deprecated, use "+cfgVersion),
 		util.BoolFlag(cfgCompatible, ""),
 		util.StringFlag(cfgListen, "0.0.0.0", ""),
 		util.IntFlag(cfgTcpPort, 1883, ""),
@@ -117,20 +234,57 @@ func Flags() []cli.Flag {
 		util.IntFlag(cfgTcpsMax, 0, ""),
 		util.IntFlag(cfgWsMax, 0, ""),
 		util.IntFlag(cfgWssMax, 0, ""),
+		util.IntFlag(cfgConnMax, 0, ""),
 		util.StringFlag(cfgTlsCert, "cred/cert", ""),
 		util.StringFlag(cfgTlsKey, "cred/key", ""),
+		util.StringFlag(cfgTlsCA, "cred/ca", ""),
+		util.StringSliceFlag(cfgTlsSNICert, ""),
+		util.StringSliceFlag(cfgTlsSNIKey, ""),
+		util.DurationFlag(cfgTlsReload, time.Minute, ""),
+		util.StringFlag(cfgTlsAuth, ClientAuthNone, ""),
+		util.StringFlag(cfgCertUser, "", ""),
+		util.StringFlag(cfgCertID, "", ""),
 		util.DurationFlag(cfgGraceTime, 10*time.Second, ""),
+		util.IntFlag(cfgKeepalive, 0, ""),
+		util.IntFlag(cfgTopicAlias, 10, ""),
+		util.IntFlag(cfgRecvMax, maxInflight, ""),
+		util.IntFlag(cfgPacketMax, 1<<20, ""),
+		util.StringSliceFlag(cfgWsPath, ""),
+		util.StringSliceFlag(cfgWsOrigins, ""),
+		util.BoolFlag(cfgWsCompress, ""),
+		util.IntFlag(cfgWsReadBuf, 1024, ""),
+		util.IntFlag(cfgWsWriteBuf, 1024, ""),
+		// auth config
+		util.BoolFlag(cfgAllowAnonymous, ""),
+		util.StringFlag(cfgPasswordFile, "", ""),
+		util.StringFlag(cfgACLFile, "", ""),
+		util.StringFlag(cfgHookAuthURL, "", ""),
+		util.StringFlag(cfgHookACLURL, "", ""),
+		util.DurationFlag(cfgHookTimeout, defaultWebhookTimeout, ""),
+		util.DurationFlag(cfgHookAllowTTL, time.Minute, ""),
+		util.DurationFlag(cfgHookDenyTTL, 10*time.Second, ""),
+		util.BoolFlag(cfgHookFailOpen, ""),
+		util.StringFlag(cfgJWTJWKS, "", ""),
+		util.StringSliceFlag(cfgJWTKeys, ""),
+		util.StringFlag(cfgJWTSecret, "", ""),
+		util.StringFlag(cfgJWTAud, "", ""),
+		util.StringFlag(cfgJWTIDClaim, defaultJWTClientIDClaim, ""),
+		util.StringFlag(cfgJWTUserClaim, defaultJWTUsernameClaim, ""),
+		util.StringFlag(cfgJWTPubClaim, defaultJWTPublishClaim, ""),
+		util.StringFlag(cfgJWTSubClaim, defaultJWTSubscribeClaim, ""),
 		// log config
 		util.StringFlag(cfgLogLevel, "info", ""),
-		util.StringFlag(cfgLogDir, "/var/log/imq/mqtt", ""),
+		util.StringFlag(cfgLogDir, "", ""),
 		// persist config
 		util.StringFlag(cfgPersistMethod, "none", ""),
 		util.IntFlag(cfgPersistMaxCount, 1000, ""),
 		util.BoolFlag(cfgPersistDropOnExceed, ""),
-		util.BoolFlag(cfgPersistDuplicateReplace, ""),
 		// file persist config
-		util.DurationFlag(cfgFilePersistInterval, time.Minute, ""),
+		util.DurationFlag(cfgFilePersistInterval, defaultFilePersistInterval, ""),
+		util.DurationFlag(cfgFilePersistIntervalDeprecated, 0, "deprecated, use "+cfgFilePersistInterval),
 		util.StringFlag(cfgFilePersistDir, "", ""),
+		// boltdb persist config
+		util.StringFlag(cfgBoltPersistFile, "", ""),
 		// redis persist config
 		util.StringFlag(cfgRedisAddr, "", ""),
 		util.StringFlag(cfgRedisAuth, "", ""),
@@ -140,35 +294,78 @@ func Flags() []cli.Flag {
 	}
 }
 
-func getConfig(ctx *cli.Context) *config {
-	return &config{
+// OptionsFromContext creates server options from command line flags
+// and config file
+func OptionsFromContext(ctx *cli.Context) *Options {
+	return &Options{
 		// service config
-		version: func() libmqtt.ProtoVersion {
-			switch ctx.String(cfgVersion) {
+		Version: func() libmqtt.ProtoVersion {
+			version := ctx.String(cfgVersion)
+			if old := ctx.String(cfgVersionDeprecated); old != "" && version == defaultVersion {
+				version = old
+			}
+			switch version {
 			case "3.1.1":
 				return libmqtt.V311
 			case "5":
 				return libmqtt.V5
 			default:
-				panic("not supported mqtt version: " + ctx.String(cfgVersion))
+				panic("not supported mqtt version: " + version)
 			}
 		}(),
-		compatible:        ctx.Bool(cfgCompatible),
-		listen:            ctx.String(cfgListen),
-		tcpPort:           ctx.Int(cfgTcpPort),
-		tcpsPort:          ctx.Int(cfgTcpsPort),
-		wsPort:            ctx.Int(cfgWsPort),
-		wssPort:           ctx.Int(cfgWssPort),
-		maxTcp:            ctx.Int(cfgTcpMax),
-		maxTcps:           ctx.Int(cfgTcpsMax),
-		maxWs:             ctx.Int(cfgWsMax),
-		maxWss:            ctx.Int(cfgWssMax),
-		tlsCertFile:       ctx.String(cfgTlsCert),
-		tlsKeyFile:        ctx.String(cfgTlsKey),
-		graceShutdownTime: ctx.Duration(cfgGraceTime),
+		Compatible:        ctx.Bool(cfgCompatible),
+		Listen:            ctx.String(cfgListen),
+		TCPPort:           ctx.Int(cfgTcpPort),
+		TCPSPort:          ctx.Int(cfgTcpsPort),
+		WSPort:            ctx.Int(cfgWsPort),
+		WSSPort:           ctx.Int(cfgWssPort),
+		MaxTCP:            ctx.Int(cfgTcpMax),
+		MaxTCPS:           ctx.Int(cfgTcpsMax),
+		MaxWS:             ctx.Int(cfgWsMax),
+		MaxWSS:            ctx.Int(cfgWssMax),
+		MaxConn:           ctx.Int(cfgConnMax),
+		TLSCertFile:       ctx.String(cfgTlsCert),
+		TLSKeyFile:        ctx.String(cfgTlsKey),
+		TLSCAFile:         ctx.String(cfgTlsCA),
+		TLSSNICerts:       ctx.StringSlice(cfgTlsSNICert),
+		TLSSNIKeys:        ctx.StringSlice(cfgTlsSNIKey),
+		TLSClientAuth:     clientAuth(ctx, cfgTlsAuth),
+		TLSCertUsername:   certField(ctx, cfgCertUser),
+		TLSCertClientID:   certField(ctx, cfgCertID),
+		TLSReloadInterval: ctx.Duration(cfgTlsReload),
+		GraceShutdownTime: ctx.Duration(cfgGraceTime),
+		Keepalive:         ctx.Int(cfgKeepalive),
+		MaxTopicAlias:     ctx.Int(cfgTopicAlias),
+		ReceiveMax:        ctx.Int(cfgRecvMax),
+		MaxPacketSize:     ctx.Int(cfgPacketMax),
+		WSPaths:           ctx.StringSlice(cfgWsPath),
+		WSOrigins:         ctx.StringSlice(cfgWsOrigins),
+		WSCompression:     ctx.Bool(cfgWsCompress),
+		WSReadBuffer:      ctx.Int(cfgWsReadBuf),
+		WSWriteBuffer:     ctx.Int(cfgWsWriteBuf),
+		// auth config
+		AllowAnonymous: ctx.Bool(cfgAllowAnonymous),
+		PasswordFile:   ctx.String(cfgPasswordFile),
+		ACLFile:        ctx.String(cfgACLFile),
+		// webhook auth config
+		WebhookAuthURL:  ctx.String(cfgHookAuthURL),
+		WebhookACLURL:   ctx.String(cfgHookACLURL),
+		WebhookTimeout:  ctx.Duration(cfgHookTimeout),
+		WebhookAllowTTL: ctx.Duration(cfgHookAllowTTL),
+		WebhookDenyTTL:  ctx.Duration(cfgHookDenyTTL),
+		WebhookFailOpen: ctx.Bool(cfgHookFailOpen),
+		// jwt auth config
+		JWTJWKSFile:       ctx.String(cfgJWTJWKS),
+		JWTKeyFiles:       ctx.StringSlice(cfgJWTKeys),
+		JWTSecret:         ctx.String(cfgJWTSecret),
+		JWTAudience:       ctx.String(cfgJWTAud),
+		JWTClientIDClaim:  ctx.String(cfgJWTIDClaim),
+		JWTUsernameClaim:  ctx.String(cfgJWTUserClaim),
+		JWTPublishClaim:   ctx.String(cfgJWTPubClaim),
+		JWTSubscribeClaim: ctx.String(cfgJWTSubClaim),
 		// log config
-		logDir: ctx.String(cfgLogDir),
-		logLevel: func() zapcore.Level {
+		LogDir: ctx.String(cfgLogDir),
+		LogLevel: func() zapcore.Level {
 			switch strings.ToLower(ctx.String(cfgLogLevel)) {
 			case "debug":
 				return zapcore.DebugLevel
@@ -187,18 +384,45 @@ func getConfig(ctx *cli.Context) *config {
 			}
 		}(),
 		// persist common config
-		persistMethod:           ctx.String(cfgPersistMethod),
-		persistMaxCount:         ctx.Int(cfgPersistMaxCount),
-		persistDropOnExceed:     ctx.Bool(cfgPersistDropOnExceed),
-		persistDuplicateReplace: ctx.Bool(cfgPersistDuplicateReplace),
+		PersistMethod:       ctx.String(cfgPersistMethod),
+		PersistMaxCount:     ctx.Int(cfgPersistMaxCount),
+		PersistDropOnExceed: ctx.Bool(cfgPersistDropOnExceed),
 		// file persist config
-		filePersistInterval: ctx.Duration(cfgFilePersistInterval),
-		filePersistDir:      ctx.String(cfgFilePersistDir),
+		FilePersistInterval: func() time.Duration {
+			interval := ctx.Duration(cfgFilePersistInterval)
+			if old := ctx.Duration(cfgFilePersistIntervalDeprecated); old != 0 && interval == defaultFilePersistInterval {
+				return old
+			}
+			return interval
+		}(),
+		FilePersistDir: ctx.String(cfgFilePersistDir),
+		// boltdb persist config
+		BoltPersistFile: ctx.String(cfgBoltPersistFile),
 		// redis persist config
-		redisAddr: ctx.String(cfgRedisAddr),
-		redisAuth: ctx.String(cfgRedisAuth),
-		redisDB:   ctx.Int(cfgRedisDB),
+		RedisAddr: ctx.String(cfgRedisAddr),
+		RedisAuth: ctx.String(cfgRedisAuth),
+		RedisDB:   ctx.Int(cfgRedisDB),
 		// etcd persist config
-		etcdAddr: ctx.String(cfgEtcdAddr),
+		EtcdAddr: ctx.String(cfgEtcdAddr),
+	}
+}
+
+// clientAuth reads client certificate verification mode
+func clientAuth(ctx *cli.Context, name string) string {
+	switch auth := strings.ToLower(ctx.String(name)); auth {
+	case ClientAuthNone, ClientAuthOptional, ClientAuthRequired:
+		return auth
+	default:
+		panic("not supported tls client auth: " + auth)
+	}
+}
+
+// certField reads client certificate field used as identity
+func certField(ctx *cli.Context, name string) string {
+	switch field := strings.ToLower(ctx.String(name)); field {
+	case "", CertFieldCN, CertFieldSAN:
+		return field
+	default:
+		panic("not supported client certificate field: " + field)
 	}
 }
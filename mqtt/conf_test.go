@@ -0,0 +1,63 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestOptionsDeprecatedKeys(t *testing.T) {
+	cases := []struct {
+		name     string
+		args     []string
+		version  libmqtt.ProtoVersion
+		interval time.Duration
+	}{
+		{"default", nil, libmqtt.V5, time.Minute},
+		{"deprecated", []string{
+			"--" + cfgVersionDeprecated, "3.1.1",
+			"--" + cfgFilePersistIntervalDeprecated, "5s",
+		}, libmqtt.V311, 5 * time.Second},
+		{"both", []string{
+			"--" + cfgVersion, "3.1.1", "--" + cfgVersionDeprecated, "5",
+			"--" + cfgFilePersistInterval, "10s", "--" + cfgFilePersistIntervalDeprecated, "5s",
+		}, libmqtt.V311, 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		var o *Options
+		app := cli.NewApp()
+		app.Flags = Flags()
+		app.Action = func(ctx *cli.Context) error {
+			o = OptionsFromContext(ctx)
+			return nil
+		}
+		if err := app.Run(append([]string{"imq"}, c.args...)); err != nil {
+			t.Fatalf("%s: run: %v", c.name, err)
+		}
+		if o.Version != c.version {
+			t.Errorf("%s: version got %v, want %v", c.name, o.Version, c.version)
+		}
+		if o.FilePersistInterval != c.interval {
+			t.Errorf("%s: interval got %v, want %v", c.name, o.FilePersistInterval, c.interval)
+		}
+	}
+}
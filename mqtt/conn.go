@@ -19,79 +19,94 @@ package mqtt
 import (
 	"bufio"
 	"context"
+	"io"
 	"net"
-	"net/http"
+	"sync"
 	"time"
 
 	mqtt "github.com/goiiot/libmqtt"
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
-var upGrader = &websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	Subprotocols:    []string{"mqtt", "mqtts"},
-}
+// time allowed from accepting connection to receiving connect packet,
+// including tls handshake
+const connectTimeout = 10 * time.Second
 
-func handleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upGrader.Upgrade(w, r, make(http.Header))
-	if err != nil {
-		log.Error("establish ws connection fail", zap.Error(err))
+func (s *Server) handleConn(conn net.Conn) {
+	if !s.track(conn) {
+		conn.Close()
 		return
 	}
 
-	defer conn.Close()
-
-	handleConn(conn.UnderlyingConn())
-}
-
-func handleConn(conn net.Conn) {
-	var (
-		pkt mqtt.Packet
-		err error
-	)
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
 	connRW := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	version, err := peekVersion(connRW.Reader)
+	if err != nil {
+		s.log.Error("connection error", zap.Error(err))
+		s.closeConn(conn)
+		return
+	}
 
-	// TODO: determine version via initial connect packet
-	switch conf.version {
-	case mqtt.V311:
-		pkt, err = mqtt.Decode(mqtt.V311, connRW)
-		if err != nil {
-			log.Error("connection error", zap.Error(err))
-			return
-		}
-	case mqtt.V5:
-		pkt, err = mqtt.Decode(mqtt.V5, connRW)
-		if err != nil {
-			log.Error("connection error", zap.Error(err))
-			return
-		}
+	if !s.acceptVersion(version) {
+		s.log.Debug("unsupported protocol version", zap.Uint8("version", byte(version)))
+		rejectVersion(connRW, version)
+		s.closeConn(conn)
+		return
 	}
 
-	connPkt, ok := pkt.(*mqtt.ConnPacket)
-	if !ok {
-		log.Error("Expect connect packet")
-		conn.Close()
+	connPkt, will, err := readConnect(version, connRW.Reader, s.opts.MaxPacketSize)
+	if err != nil {
+		s.log.Error("connection error", zap.Error(err))
+		if err == errPacketTooLarge && version == mqtt.V5 {
+			writePacket(connRW, version, &mqtt.ConnAckPacket{Code: mqtt.CodePacketTooLarge}, 0)
+		}
+		s.closeConn(conn)
 		return
 	}
 
-	c := newConn(mqtt.V311, conn, connRW, connPkt)
-	// TODO store client connection
+	c := newConn(s, version, conn, connRW, connPkt)
+	c.will = will
+	if !c.handshake() {
+		s.closeConn(conn)
+		return
+	}
+	// keepalive takes over after connack
+	conn.SetReadDeadline(time.Time{})
 
 	go c.handleConnRecv()
 	go c.handleConnSend()
+	if c.keepalive > 0 {
+		go c.handleKeepalive()
+	}
+	if !c.authInfo.Expiry.IsZero() {
+		go c.handleExpiry()
+	}
+
+	// retransmit messages not acknowledged in previous connection
+	for _, pkt := range c.pending {
+		c.send(pkt)
+	}
+	c.pending = nil
+	c.session.flush()
+}
+
+// closeConn closes connection failed in handshake
+func (s *Server) closeConn(conn net.Conn) {
+	conn.Close()
+	s.untrack(conn)
 }
 
-func newConn(version mqtt.ProtoVersion, conn net.Conn, connRW *bufio.ReadWriter, connPkt *mqtt.ConnPacket) *connImpl {
+func newConn(srv *Server, version mqtt.ProtoVersion, conn net.Conn, connRW *bufio.ReadWriter, connPkt *mqtt.ConnPacket) *connImpl {
 	ctx, cancel := context.WithCancel(context.TODO())
 	c := &connImpl{
+		srv:     srv,
 		conn:    conn,
 		connRW:  connRW,
 		connPkt: connPkt,
 		version: version,
 		recvC:   make(chan mqtt.Packet),
 		sendC:   make(chan mqtt.Packet),
+		keepC:   make(chan struct{}, 1),
 		pubC:    make(chan *mqtt.PublishPacket),
 		ctx:     ctx,
 		exit:    cancel,
@@ -100,63 +115,679 @@ func newConn(version mqtt.ProtoVersion, conn net.Conn, connRW *bufio.ReadWriter,
 }
 
 type connImpl struct {
-	conn    net.Conn          // actual connection with client
-	connRW  *bufio.ReadWriter // buffered connection
-	version mqtt.ProtoVersion // mqtt version in use
-	connPkt *mqtt.ConnPacket  // initial connect packet
+	srv        *Server           // server accepted the connection
+	conn       net.Conn          // actual connection with client
+	connRW     *bufio.ReadWriter // buffered connection
+	version    mqtt.ProtoVersion // mqtt version in use
+	connPkt    *mqtt.ConnPacket  // initial connect packet
+	clientID   string            // client id in use, may be assigned by server
+	session    *session          // session bound to this connection
+	authInfo   *AuthInfo         // identity of client authenticated
+	reAuth     AuthExchange      // re-authentication in progress, if any
+	reAuthInfo *AuthInfo         // identity of client re-authenticating
+	will       *willMsg          // will message, nil if none or disconnected normally
+	keepalive  time.Duration     // keepalive in use, 0 if disabled
+	aliasIn    map[uint16]string // topic aliases of client (mqtt 5)
+	aliasOut   *aliasCache       // topic aliases of server, nil if not accepted by client
+	pending    []mqtt.Packet     // packets to retransmit after connack
 
 	// channels for client server communication
 	recvC chan mqtt.Packet         // server recv channel
 	sendC chan mqtt.Packet         // server send channel
-	keepC chan int                 // keepalive channel
+	keepC chan struct{}            // keepalive channel
 	pubC  chan *mqtt.PublishPacket // server publish channel
 
 	// context for exit client
-	ctx  context.Context
-	exit context.CancelFunc
+	ctx       context.Context
+	exit      context.CancelFunc
+	closeOnce sync.Once
+
+	writeMu sync.Mutex // serializes writes of send loop and disconnect
+}
+
+// time allowed to send disconnect packet before connection closed
+const disconnectTimeout = time.Second
+
+// handshake validates the connect packet and answers it with connack,
+// return false if the connection has been rejected and should be closed
+func (c *connImpl) handshake() bool {
+	requestedID := c.connPkt.ClientID
+	certUser := c.useCertIdentity()
+
+	code, err := checkConnect(c.connPkt)
+	if err != nil {
+		c.srv.log.Error("invalid connect packet", zap.Error(err))
+		code, ok := connectErrCodes[err]
+		if !ok {
+			code = mqtt.CodeMalformedPacket
+		}
+		c.refuse(code)
+		return false
+	}
+
+	if code != mqtt.CodeSuccess {
+		c.srv.log.Debug("connection refused", zap.String("client", c.connPkt.ClientID), zap.Uint8("code", code))
+		c.refuse(code)
+		return false
+	}
+
+	c.authInfo = &AuthInfo{
+		ClientID: c.connPkt.ClientID,
+		Username: c.connPkt.Username,
+		Password: []byte(c.connPkt.Password),
+		Addr:     c.conn.RemoteAddr(),
+		Cert:     peerCert(c.conn),
+	}
+
+	var authData []byte
+	authMethod := c.authMethod()
+	if authMethod != "" {
+		authData, err = c.enhancedAuth(c.authInfo)
+	} else {
+		err = c.srv.authenticate(c.authInfo, certUser)
+	}
+	if err != nil {
+		c.srv.log.Info("authentication failed", zap.String("client", c.connPkt.ClientID),
+			zap.String("username", c.connPkt.Username), zap.Error(err))
+		c.refuse(authCode(err))
+		return false
+	}
+	c.connPkt.ClientID = c.authInfo.ClientID
+	c.connPkt.Username = c.authInfo.Username
+
+	ack := &mqtt.ConnAckPacket{Code: mqtt.CodeSuccess}
+	if c.version == mqtt.V5 {
+		ack.Props = &mqtt.ConnAckProps{AuthMethod: authMethod, AuthData: authData}
+	}
+
+	c.clientID = c.connPkt.ClientID
+	if c.clientID == "" {
+		c.clientID = genClientID()
+	}
+	if ack.Props != nil && c.clientID != requestedID {
+		ack.Props.AssignedClientID = c.clientID
+	}
+	c.authInfo.ClientID = c.clientID
+
+	if c.connPkt.IsWill && !c.srv.authorize(c.authInfo, ACLPublish, c.connPkt.WillTopic) {
+		c.srv.log.Info("will topic not authorized", zap.String("client", c.clientID), zap.String("topic", c.connPkt.WillTopic))
+		c.refuse(mqtt.CodeNotAuthorized)
+		return false
+	}
+
+	c.keepalive = time.Duration(c.connPkt.Keepalive) * time.Second
+	if ack.Props != nil && c.srv.opts.Keepalive > 0 {
+		// server keepalive overrides the one asked by client (mqtt 5)
+		c.keepalive = time.Duration(c.srv.opts.Keepalive) * time.Second
+		ack.Props.ServerKeepalive = uint16(c.srv.opts.Keepalive)
+	}
+
+	if ack.Props != nil {
+		ack.Props.MaxRecv = uint16(c.srv.opts.ReceiveMax)
+		ack.Props.MaxPacketSize = uint32(c.srv.opts.MaxPacketSize)
+		ack.Props.MaxTopicAlias = uint16(c.srv.opts.MaxTopicAlias)
+		if props := c.connPkt.Props; props != nil && props.MaxTopicAlias > 0 {
+			c.aliasOut = newAliasCache(props.MaxTopicAlias)
+		}
+	}
+
+	present, prev := c.srv.sessions.open(c, c.connPkt.CleanSession, c.sessionExpiry())
+	if prev != nil {
+		c.srv.log.Debug("session taken over", zap.String("client", c.clientID))
+		prev.disconnect(mqtt.CodeSessionTakenOver, "")
+	}
+	ack.Present = present
+
+	if err := c.write(ack); err != nil {
+		c.srv.log.Error("send connack failed", zap.String("client", c.clientID), zap.Error(err))
+		c.close()
+		return false
+	}
+
+	c.srv.log.Debug("client connected", zap.String("client", c.clientID), zap.Bool("present", ack.Present))
+	return true
+}
+
+// useCertIdentity replaces username and client id with the fields of
+// verified client certificate as configured, return true if username
+// is taken from the certificate
+func (c *connImpl) useCertIdentity() bool {
+	if c.srv.opts.TLSCertUsername == "" && c.srv.opts.TLSCertClientID == "" {
+		return false
+	}
+
+	cert := peerCert(c.conn)
+	if cert == nil {
+		return false
+	}
+
+	if id := certIdentity(cert, c.srv.opts.TLSCertClientID); id != "" {
+		c.srv.log.Debug("client id from certificate", zap.String("client", id), zap.String("requested", c.connPkt.ClientID))
+		c.connPkt.ClientID = id
+	}
+
+	user := certIdentity(cert, c.srv.opts.TLSCertUsername)
+	if user == "" {
+		return false
+	}
+	c.connPkt.Username = user
+	return true
+}
+
+// refuse the connection with connack, which is omitted for mqtt 3.1.1
+// clients when the reason has no return code
+func (c *connImpl) refuse(code byte) {
+	if code, ok := connAckCode(c.version, code); ok {
+		c.write(&mqtt.ConnAckPacket{Code: code})
+	}
 }
 
 func (c *connImpl) handleConnRecv() {
-	// TODO: complete receive logic
+	defer c.close()
+
 	for {
 		select {
 		case <-c.ctx.Done():
+			return
 		default:
-			pkt, err := mqtt.Decode(c.version, c.connRW)
+			pkt, err := readPacket(c.version, c.connRW.Reader, c.srv.opts.MaxPacketSize)
+			if err == errPacketTooLarge {
+				c.srv.log.Error("packet too large", zap.String("client", c.clientID), zap.Int("max", c.srv.opts.MaxPacketSize))
+				c.disconnect(mqtt.CodePacketTooLarge, "")
+				return
+			}
 			if err != nil {
+				if _, ok := err.(net.Error); !ok && err != io.EOF && err != io.ErrUnexpectedEOF {
+					c.srv.log.Error("malformed packet", zap.String("client", c.clientID), zap.Error(err))
+					c.disconnect(mqtt.CodeMalformedPacket, err.Error())
+				}
 				return
 			}
 
-			// TODO: react to packet received
-			switch pkt.(type) {
+			// any packet received resets keepalive timer
+			select {
+			case c.keepC <- struct{}{}:
+			default:
+			}
+
+			if pkt == mqtt.PingReqPacket {
+				c.send(mqtt.PingRespPacket)
+				continue
+			}
+
+			switch p := pkt.(type) {
+			case *mqtt.PublishPacket:
+				if !c.handlePublish(p) {
+					return
+				}
+			case *mqtt.PubAckPacket:
+				c.session.ackPub(p.PacketID)
+			case *mqtt.PubRecvPacket:
+				c.handlePubRecv(p)
+			case *mqtt.PubRelPacket:
+				comp := &mqtt.PubCompPacket{PacketID: p.PacketID}
+				if !c.session.releaseQos2(p.PacketID) {
+					comp.Code = mqtt.CodePacketIdentifierNotFound
+				}
+				c.send(comp)
+			case *mqtt.PubCompPacket:
+				c.session.compPub(p.PacketID)
+			case *mqtt.SubscribePacket:
+				if !c.handleSubscribe(p, nil) {
+					return
+				}
+			case *subscribePacket:
+				if !c.handleSubscribe(&p.SubscribePacket, p.Options) {
+					return
+				}
+			case *mqtt.UnSubPacket:
+				c.handleUnSub(p)
+			case *mqtt.AuthPacket:
+				if !c.handleAuth(p) {
+					return
+				}
+			case *mqtt.ConnPacket:
+				c.srv.log.Error("duplicate connect packet", zap.String("client", c.clientID))
+				c.disconnect(mqtt.CodeProtoError, "duplicate connect packet")
+				return
+			case *mqtt.DisConnPacket:
+				c.handleDisconnect(p)
+				return
 			}
 		}
 	}
 }
 
 func (c *connImpl) handleConnSend() {
-	// TODO: complete send logic
+	// packets to send before reading channels again, which are queued
+	// messages taking the place of messages discarded for size
+	var backlog []mqtt.Packet
 	for {
-		select {
-		case <-c.ctx.Done():
-		case <-c.sendC:
-		case <-c.pubC:
+		var pkt mqtt.Packet
+		if len(backlog) > 0 {
+			pkt, backlog = backlog[0], backlog[1:]
+		} else {
+			select {
+			case <-c.ctx.Done():
+				return
+			case pkt = <-c.sendC:
+			case p := <-c.pubC:
+				pkt = p
+			}
+		}
+
+		p, isPublish := pkt.(*mqtt.PublishPacket)
+		var err error
+		if isPublish {
+			err = c.write(c.applyAlias(p))
+		} else {
+			err = c.write(pkt)
+		}
+
+		if err == errPacketTooLarge && isPublish {
+			backlog = append(backlog, c.dropPublish(p)...)
+			continue
+		}
+		if err != nil {
+			// control packets are never dropped
+			c.srv.log.Error("send packet failed", zap.String("client", c.clientID), zap.Error(err))
+			c.close()
+			return
 		}
 	}
 }
 
+// handleKeepalive closes the connection when no packet has been
+// received from client for one and a half times the keepalive
 func (c *connImpl) handleKeepalive() {
-	interval := time.Duration(c.connPkt.Keepalive) * time.Second
-	timer := time.NewTimer(interval)
+	timeout := c.keepalive * 3 / 2
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	for {
 		select {
 		case <-c.ctx.Done():
+			return
+		case <-c.keepC:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
 		case <-timer.C:
+			c.srv.log.Debug("keepalive timeout", zap.String("client", c.clientID), zap.Duration("keepalive", c.keepalive))
+			c.disconnect(mqtt.CodeKeepaliveTimeout, "")
+			return
+		}
+	}
+}
+
+// handleExpiry closes the connection when identity of client expires
+func (c *connImpl) handleExpiry() {
+	timer := time.NewTimer(time.Until(c.authInfo.Expiry))
+	defer timer.Stop()
+
+	select {
+	case <-c.ctx.Done():
+	case <-timer.C:
+		c.srv.log.Info("authentication expired", zap.String("client", c.clientID))
+		c.disconnect(mqtt.CodeMaxConnectTime, "authentication expired")
+	}
+}
 
+// handlePublish routes message to subscribers,
+// return false if the connection should be closed
+func (c *connImpl) handlePublish(pkt *mqtt.PublishPacket) bool {
+	if err := c.resolveAlias(pkt); err != nil {
+		c.srv.log.Error("invalid topic alias", zap.String("client", c.clientID), zap.Error(err))
+		code := byte(mqtt.CodeTopicAliasInvalid)
+		if err == errUnknownTopicAlias {
+			code = mqtt.CodeProtoError
 		}
+		c.disconnect(code, err.Error())
+		return false
 	}
+
+	if !validTopicName(pkt.TopicName) {
+		c.srv.log.Error("invalid topic name", zap.String("client", c.clientID), zap.String("topic", pkt.TopicName))
+		c.disconnect(mqtt.CodeTopicNameInvalid, "")
+		return false
+	}
+
+	if pkt.Qos > mqtt.Qos2 {
+		c.srv.log.Error("invalid publish qos", zap.String("client", c.clientID), zap.Uint8("qos", pkt.Qos))
+		c.disconnect(mqtt.CodeMalformedPacket, "invalid publish qos")
+		return false
+	}
+
+	if c.version == mqtt.V5 && pkt.Qos > mqtt.Qos0 && !c.session.recvQuota(pkt.PacketID, pkt.Qos, c.srv.opts.ReceiveMax) {
+		c.srv.log.Error("receive maximum exceeded", zap.String("client", c.clientID), zap.Int("max", c.srv.opts.ReceiveMax))
+		c.disconnect(mqtt.CodeReceiveMaxExceeded, "")
+		return false
+	}
+
+	if !c.srv.authorize(c.authInfo, ACLPublish, pkt.TopicName) {
+		c.srv.log.Info("publish not authorized", zap.String("client", c.clientID), zap.String("topic", pkt.TopicName))
+		c.refusePublish(pkt)
+		return true
+	}
+
+	if pkt.IsRetain {
+		c.srv.retained.set(pkt)
+	}
+
+	switch pkt.Qos {
+	case mqtt.Qos0:
+		c.srv.publish(pkt, c.clientID)
+	case mqtt.Qos1:
+		c.srv.publish(pkt, c.clientID)
+		c.send(&mqtt.PubAckPacket{PacketID: pkt.PacketID})
+	case mqtt.Qos2:
+		// deliver on first receipt, duplicates are only acknowledged
+		if c.session.recvQos2(pkt.PacketID) {
+			c.srv.publish(pkt, c.clientID)
+		}
+		c.send(&mqtt.PubRecvPacket{PacketID: pkt.PacketID})
+	}
+	return true
+}
+
+// refusePublish acknowledges publish packet without delivering it, with
+// not authorized (mqtt 5), mqtt 3.1.1 clients can't be told so and the
+// message is silently dropped
+func (c *connImpl) refusePublish(pkt *mqtt.PublishPacket) {
+	code := byte(mqtt.CodeSuccess)
+	if c.version == mqtt.V5 {
+		code = mqtt.CodeNotAuthorized
+	}
+
+	switch pkt.Qos {
+	case mqtt.Qos1:
+		c.send(&mqtt.PubAckPacket{PacketID: pkt.PacketID, Code: code})
+	case mqtt.Qos2:
+		if code == mqtt.CodeSuccess {
+			// pubrel is expected to complete the flow
+			c.session.recvQos2(pkt.PacketID)
+		}
+		c.send(&mqtt.PubRecvPacket{PacketID: pkt.PacketID, Code: code})
+	}
+}
+
+// handlePubRecv continues outbound qos 2 delivery with pubrel
+func (c *connImpl) handlePubRecv(pkt *mqtt.PubRecvPacket) {
+	if pkt.Code >= mqtt.CodeUnspecifiedError {
+		// message refused by client, delivery ends here
+		c.session.recPub(pkt.PacketID, pkt.Code)
+		c.session.flush()
+		return
+	}
+
+	rel := &mqtt.PubRelPacket{PacketID: pkt.PacketID}
+	if !c.session.recPub(pkt.PacketID, pkt.Code) {
+		rel.Code = mqtt.CodePacketIdentifierNotFound
+	}
+	c.send(rel)
+}
+
+// handleSubscribe adds subscriptions and answers with suback, opts are
+// subscription options of mqtt 5 and nil for mqtt 3.1.1, return false
+// if the connection should be closed
+func (c *connImpl) handleSubscribe(pkt *mqtt.SubscribePacket, opts []subOptions) bool {
+	if len(pkt.Topics) == 0 {
+		c.srv.log.Error("subscribe without topic filter", zap.String("client", c.clientID))
+		c.disconnect(mqtt.CodeProtoError, "subscribe without topic filter")
+		return false
+	}
+
+	codes := make([]byte, len(pkt.Topics))
+	retained := make([]*mqtt.Topic, 0, len(pkt.Topics))
+	for i, t := range pkt.Topics {
+		if t.Qos > mqtt.Qos2 {
+			c.srv.log.Error("invalid subscribe qos", zap.String("client", c.clientID), zap.Uint8("qos", t.Qos))
+			c.disconnect(mqtt.CodeMalformedPacket, "invalid subscribe qos")
+			return false
+		}
+
+		if !validTopicFilter(t.Name) {
+			codes[i] = mqtt.SubFail
+			continue
+		}
+
+		if !c.srv.authorize(c.authInfo, ACLSubscribe, t.Name) {
+			c.srv.log.Info("subscribe not authorized", zap.String("client", c.clientID), zap.String("topic", t.Name))
+			codes[i] = mqtt.SubFail
+			if c.version == mqtt.V5 {
+				codes[i] = mqtt.CodeNotAuthorized
+			}
+			continue
+		}
+
+		o := subOptions(t.Qos)
+		if opts != nil {
+			o = opts[i]
+		}
+
+		isNew := c.session.subscribe(t.Name, o)
+		codes[i] = t.Qos
+		if h := o.retainHandling(); h == retainAlways || h == retainIfNew && isNew {
+			retained = append(retained, t)
+		}
+	}
+
+	c.send(&mqtt.SubAckPacket{PacketID: pkt.PacketID, Codes: codes})
+
+	// send retained messages after suback
+	for _, t := range retained {
+		for _, msg := range c.srv.retained.match(t.Name) {
+			c.session.deliver(msg, t.Qos, true)
+		}
+	}
+	return true
+}
+
+// handleUnSub removes subscriptions and answers with unsuback
+func (c *connImpl) handleUnSub(pkt *mqtt.UnSubPacket) {
+	codes := make([]byte, len(pkt.TopicNames))
+	for i, filter := range pkt.TopicNames {
+		if !c.session.unsubscribe(filter) {
+			codes[i] = mqtt.CodeNoSubscriptionExisted
+		}
+	}
+
+	c.send(&unSubAckPacket{
+		UnSubAckPacket: mqtt.UnSubAckPacket{PacketID: pkt.PacketID},
+		Codes:          codes,
+	})
+}
+
+// handleDisconnect discards will message when the client disconnected
+// normally, mqtt 5 clients may keep it with other reason codes and
+// update session expiry interval
+func (c *connImpl) handleDisconnect(pkt *mqtt.DisConnPacket) {
+	c.srv.log.Debug("client disconnected", zap.String("client", c.clientID), zap.Uint8("code", pkt.Code))
+	if pkt.Props != nil && pkt.Props.SessionExpiryInterval != 0 {
+		if c.sessionExpiry() == 0 {
+			// session expiry can not be set on disconnect when it was
+			// absent on connect, will message is kept for the violation
+			c.srv.log.Error("session expiry set on disconnect", zap.String("client", c.clientID))
+			c.disconnect(mqtt.CodeProtoError, "session expiry was absent on connect")
+			return
+		}
+		c.session.setExpiry(pkt.Props.SessionExpiryInterval)
+	}
+
+	if pkt.Code == mqtt.CodeNormalDisconn {
+		c.will = nil
+	}
+}
+
+// receiveMax returns max qos 1 and qos 2 messages the client accepts
+// inflight, which is only limited by packet id for mqtt 3.1.1 clients
+func (c *connImpl) receiveMax() int {
+	if c.connPkt.Props == nil || c.connPkt.Props.MaxRecv == 0 {
+		return maxInflight
+	}
+	return int(c.connPkt.Props.MaxRecv)
+}
+
+// maxPacketSize returns max size of packets the client accepts,
+// 0 if not limited
+func (c *connImpl) maxPacketSize() int {
+	if c.connPkt.Props == nil {
+		return 0
+	}
+	return int(c.connPkt.Props.MaxPacketSize)
+}
+
+// dropPublish discards message exceeding max packet size of client,
+// its delivery is regarded as completed, return packets to send for the
+// room made in inflight window
+func (c *connImpl) dropPublish(pkt *mqtt.PublishPacket) []mqtt.Packet {
+	c.srv.log.Debug("message too large for client", zap.String("client", c.clientID),
+		zap.String("topic", pkt.TopicName), zap.Int("max", c.maxPacketSize()))
+
+	if c.aliasOut != nil {
+		// client has not been told the alias
+		c.aliasOut.forget(pkt.TopicName)
+	}
+
+	if pkt.Qos == mqtt.Qos0 {
+		return nil
+	}
+	// sending via channels would block the send loop, which is the caller
+	return c.session.discard(c, pkt.PacketID)
+}
+
+// sessionExpiry returns the session expiry interval asked by client,
+// mqtt 3.1.1 sessions without clean session flag never expire
+func (c *connImpl) sessionExpiry() uint32 {
+	if c.version == mqtt.V5 {
+		if c.connPkt.Props == nil {
+			return 0
+		}
+		return c.connPkt.Props.SessionExpiryInterval
+	}
+
+	if c.connPkt.CleanSession {
+		return 0
+	}
+	return expiryNever
+}
+
+// send packet to client via send loop
+func (c *connImpl) send(pkt mqtt.Packet) {
+	select {
+	case <-c.ctx.Done():
+	case c.sendC <- pkt:
+	}
+}
+
+// publish message to client via send loop
+func (c *connImpl) publish(pkt *mqtt.PublishPacket) {
+	select {
+	case <-c.ctx.Done():
+	case c.pubC <- pkt:
+	}
+}
+
+// write packet to client and flush immediately, reason string and user
+// properties are left out if the packet exceeds max packet size of client
+func (c *connImpl) write(pkt mqtt.Packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := writePacket(c.connRW, c.version, pkt, c.maxPacketSize())
+	if err == errPacketTooLarge {
+		if p := withoutReason(pkt); p != nil {
+			err = writePacket(c.connRW, c.version, p, c.maxPacketSize())
+		}
+	}
+	return err
+}
+
+// close the connection and release the session bound to it,
+// will message is armed unless the client disconnected normally
+func (c *connImpl) close() {
+	c.closeOnce.Do(func() {
+		c.exit()
+		c.conn.Close()
+		defer c.srv.untrack(c.conn)
+		if c.session == nil {
+			return
+		}
+
+		c.session.detach(c)
+		if c.will != nil {
+			c.session.setWill(c.will)
+		}
+		c.srv.sessions.release(c.session)
+	})
+}
+
+// disconnect closes the connection on behalf of server, mqtt 5 clients
+// are told the reason code and optional reason string before closed
+func (c *connImpl) disconnect(code byte, reason string) {
+	pkt := &mqtt.DisConnPacket{Code: code}
+	if reason != "" {
+		pkt.Props = &mqtt.DisConnProps{Reason: reason}
+	}
+	c.disconnectWith(pkt)
 }
 
-func (c *connImpl) disconnect(reason byte) {
-	// TODO: disconnect with reason code
+// disconnectWith sends the disconnect packet, which may carry user
+// properties or server reference, to mqtt 5 clients and closes the
+// connection, will message is published as for abnormal disconnect
+func (c *connImpl) disconnectWith(pkt *mqtt.DisConnPacket) {
+	if c.ctx.Err() != nil {
+		// already closed
+		return
+	}
+
+	c.srv.log.Debug("disconnect client", zap.String("client", c.clientID), zap.Uint8("code", pkt.Code))
+	if c.version == mqtt.V5 {
+		c.conn.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+		if err := c.write(pkt); err != nil {
+			c.srv.log.Debug("send disconnect failed", zap.String("client", c.clientID), zap.Error(err))
+		}
+	}
+	c.close()
+}
+
+// decodePacket decodes one packet from client, malformed packets
+// making the decoder panic are reported as bad packet
+func decodePacket(version mqtt.ProtoVersion, r mqtt.BufferedReader) (pkt mqtt.Packet, err error) {
+	defer func() {
+		if recover() != nil {
+			pkt, err = nil, mqtt.ErrDecodeBadPacket
+		}
+	}()
+	return mqtt.Decode(version, r)
+}
+
+// setVersion sets the protocol version used to encode the packet
+func setVersion(pkt mqtt.Packet, version mqtt.ProtoVersion) {
+	switch p := pkt.(type) {
+	case *mqtt.ConnAckPacket:
+		p.ProtoVersion = version
+	case *mqtt.PublishPacket:
+		p.ProtoVersion = version
+	case *mqtt.PubAckPacket:
+		p.ProtoVersion = version
+	case *mqtt.PubRecvPacket:
+		p.ProtoVersion = version
+	case *mqtt.PubRelPacket:
+		p.ProtoVersion = version
+	case *mqtt.PubCompPacket:
+		p.ProtoVersion = version
+	case *mqtt.SubAckPacket:
+		p.ProtoVersion = version
+	case *mqtt.UnSubAckPacket:
+		p.ProtoVersion = version
+	case *mqtt.DisConnPacket:
+		p.ProtoVersion = version
+	case *mqtt.AuthPacket:
+		p.ProtoVersion = version
+	}
 }
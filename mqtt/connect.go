@@ -0,0 +1,219 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+// connack return codes of mqtt 3.1.1, reason codes of mqtt 5 are used
+// internally and converted by connAckCode for mqtt 3.1.1 clients
+const (
+	codeUnacceptableVersion byte = 0x01 // unacceptable protocol version
+	codeIdentifierRejected  byte = 0x02 // client identifier rejected
+	codeServerUnavailable   byte = 0x03 // server unavailable
+	codeBadUserPass         byte = 0x04 // bad user name or password
+	codeNotAuthorized       byte = 0x05 // not authorized
+)
+
+const (
+	protoName      = "MQTT"
+	clientIDPrefix = "imq-"
+
+	maxProtoNameLen = 6 // length of "MQIsdp" used by mqtt 3.1
+)
+
+var (
+	errNotConnect       = errors.New("first packet is not connect")
+	errBadRemainLength  = errors.New("malformed remaining length")
+	errBadProtoName     = errors.New("invalid protocol name")
+	errBadWillFlags     = errors.New("invalid will flags")
+	errBadWillTopic     = errors.New("invalid will topic")
+	errPasswordNoUser   = errors.New("password set without user name")
+	errBadUTF8Encoding  = errors.New("invalid utf-8 encoded string")
+	errAuthDataNoMethod = errors.New("auth data set without auth method")
+)
+
+// connack reason codes of invalid connect packets (mqtt 5)
+var connectErrCodes = map[error]byte{
+	errBadProtoName:     mqtt.CodeUnsupportedProtoVersion,
+	errBadWillFlags:     mqtt.CodeMalformedPacket,
+	errBadWillTopic:     mqtt.CodeTopicNameInvalid,
+	errAuthDataNoMethod: mqtt.CodeProtoError,
+}
+
+// connAckCode converts mqtt 5 connack reason code for the protocol version,
+// return false if mqtt 3.1.1 has no return code for it and connection
+// should be closed without connack
+func connAckCode(version mqtt.ProtoVersion, code byte) (byte, bool) {
+	if version == mqtt.V5 || code == mqtt.CodeSuccess {
+		return code, true
+	}
+
+	switch code {
+	case mqtt.CodeUnsupportedProtoVersion:
+		return codeUnacceptableVersion, true
+	case mqtt.CodeClientIdNotValid:
+		return codeIdentifierRejected, true
+	case mqtt.CodeServerUnavail, mqtt.CodeServerBusy, mqtt.CodeQuotaExceeded,
+		mqtt.CodeConnectionRateExceeded:
+		return codeServerUnavailable, true
+	case mqtt.CodeBadUserPass:
+		return codeBadUserPass, true
+	case mqtt.CodeNotAuthorized, mqtt.CodeBanned, mqtt.CodeBadAuthenticationMethod:
+		return codeNotAuthorized, true
+	default:
+		return 0, false
+	}
+}
+
+// peekVersion reads ahead the protocol level of the connect packet
+// without consuming any byte of it
+func peekVersion(r *bufio.Reader) (mqtt.ProtoVersion, error) {
+	// fixed header, 1 byte packet type and 1 to 4 bytes remaining length
+	n := 1
+	for {
+		n++
+		header, err := r.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+
+		if mqtt.CtrlType(header[0]>>4) != mqtt.CtrlConn {
+			return 0, errNotConnect
+		}
+
+		if header[n-1]&0x80 == 0 {
+			break
+		}
+
+		if n == 5 {
+			return 0, errBadRemainLength
+		}
+	}
+
+	// variable header, protocol name and protocol level
+	name, err := r.Peek(n + 2)
+	if err != nil {
+		return 0, err
+	}
+
+	nameLen := int(name[n])<<8 | int(name[n+1])
+	if nameLen > maxProtoNameLen {
+		return 0, errBadProtoName
+	}
+
+	level, err := r.Peek(n + 2 + nameLen + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return mqtt.ProtoVersion(level[len(level)-1]), nil
+}
+
+// acceptVersion reports whether clients using the protocol version
+// can be served, lower versions are only accepted in compatible mode
+func (s *Server) acceptVersion(version mqtt.ProtoVersion) bool {
+	switch version {
+	case s.opts.Version:
+		return true
+	case mqtt.V311:
+		return s.opts.Compatible && s.opts.Version == mqtt.V5
+	default:
+		return false
+	}
+}
+
+// rejectVersion answers connect packet of unsupported protocol version,
+// using the connack format the client is expected to understand
+func rejectVersion(w *bufio.ReadWriter, version mqtt.ProtoVersion) {
+	if version != mqtt.V5 {
+		// answer unknown versions in mqtt 3.1.1 format
+		version = mqtt.V311
+	}
+
+	code, _ := connAckCode(version, mqtt.CodeUnsupportedProtoVersion)
+	writePacket(w, version, &mqtt.ConnAckPacket{Code: code}, 0)
+}
+
+// checkConnect validates the connect packet and returns connack reason
+// code, a non nil error means a protocol violation, which is answered
+// with reason code from connectErrCodes or malformed packet (mqtt 5)
+func checkConnect(pkt *mqtt.ConnPacket) (byte, error) {
+	if pkt.ProtoName != protoName {
+		return 0, errBadProtoName
+	}
+
+	if pkt.IsWill {
+		if pkt.WillQos > mqtt.Qos2 {
+			return 0, errBadWillFlags
+		}
+
+		if !validTopicName(pkt.WillTopic) {
+			return 0, errBadWillTopic
+		}
+	} else if pkt.WillQos != mqtt.Qos0 || pkt.WillRetain {
+		return 0, errBadWillFlags
+	}
+
+	if pkt.ProtoVersion != mqtt.V5 && pkt.Username == "" && pkt.Password != "" {
+		// allowed since mqtt 5
+		return 0, errPasswordNoUser
+	}
+
+	if !validString(pkt.Username) {
+		return 0, errBadUTF8Encoding
+	}
+
+	if pkt.Props != nil && pkt.Props.AuthMethod == "" && len(pkt.Props.AuthData) > 0 {
+		return 0, errAuthDataNoMethod
+	}
+
+	if pkt.ClientID == "" {
+		// server assigns client id only for clean sessions of mqtt 3.1.1,
+		// mqtt 5 clients get assigned id regardless of clean start
+		if pkt.ProtoVersion != mqtt.V5 && !pkt.CleanSession {
+			return mqtt.CodeClientIdNotValid, nil
+		}
+	} else if !validString(pkt.ClientID) {
+		return mqtt.CodeClientIdNotValid, nil
+	}
+
+	return mqtt.CodeSuccess, nil
+}
+
+// validString checks mqtt utf-8 encoded string rules
+func validString(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsRune(s, 0)
+}
+
+// genClientID generates a unique client id for clients connected with
+// empty client id
+func genClientID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic("generate client id failed: " + err.Error())
+	}
+	return clientIDPrefix + hex.EncodeToString(id)
+}
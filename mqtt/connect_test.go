@@ -0,0 +1,96 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+func TestCheckConnect(t *testing.T) {
+	conn := func(version mqtt.ProtoVersion, id string, clean bool) *mqtt.ConnPacket {
+		pkt := &mqtt.ConnPacket{ProtoName: protoName, ClientID: id, CleanSession: clean}
+		pkt.ProtoVersion = version
+		return pkt
+	}
+
+	cases := []struct {
+		name string
+		pkt  *mqtt.ConnPacket
+		code byte
+		err  error
+	}{
+		{"v3 client id", conn(mqtt.V311, "c1", false), mqtt.CodeSuccess, nil},
+		{"v3 empty id clean", conn(mqtt.V311, "", true), mqtt.CodeSuccess, nil},
+		{"v3 empty id persistent", conn(mqtt.V311, "", false), mqtt.CodeClientIdNotValid, nil},
+		{"v5 empty id clean", conn(mqtt.V5, "", true), mqtt.CodeSuccess, nil},
+		{"v5 empty id persistent", conn(mqtt.V5, "", false), mqtt.CodeSuccess, nil},
+		{"bad utf-8 client id", conn(mqtt.V311, "a\x00b", true), mqtt.CodeClientIdNotValid, nil},
+		{"bad protocol name", &mqtt.ConnPacket{ProtoName: "MQTX"}, 0, errBadProtoName},
+	}
+
+	for _, c := range cases {
+		code, err := checkConnect(c.pkt)
+		if code != c.code || err != c.err {
+			t.Errorf("%s: got (%#x, %v), want (%#x, %v)", c.name, code, err, c.code, c.err)
+		}
+	}
+}
+
+func TestCheckConnectPasswordNoUser(t *testing.T) {
+	pkt := &mqtt.ConnPacket{ProtoName: protoName, ClientID: "c1", Password: "p"}
+	pkt.ProtoVersion = mqtt.V311
+	if _, err := checkConnect(pkt); err != errPasswordNoUser {
+		t.Errorf("v3: got %v, want %v", err, errPasswordNoUser)
+	}
+
+	pkt.ProtoVersion = mqtt.V5
+	if _, err := checkConnect(pkt); err != nil {
+		t.Errorf("v5: got %v, want nil", err)
+	}
+}
+
+func TestConnAckCode(t *testing.T) {
+	cases := []struct {
+		code    byte
+		v3      byte
+		v3Reply bool
+	}{
+		{mqtt.CodeSuccess, mqtt.CodeSuccess, true},
+		{mqtt.CodeUnsupportedProtoVersion, codeUnacceptableVersion, true},
+		{mqtt.CodeClientIdNotValid, codeIdentifierRejected, true},
+		{mqtt.CodeServerBusy, codeServerUnavailable, true},
+		{mqtt.CodeQuotaExceeded, codeServerUnavailable, true},
+		{mqtt.CodeBadUserPass, codeBadUserPass, true},
+		{mqtt.CodeBanned, codeNotAuthorized, true},
+		{mqtt.CodeBadAuthenticationMethod, codeNotAuthorized, true},
+		// no return code of mqtt 3.1.1, connection is closed
+		{mqtt.CodeMalformedPacket, 0, false},
+		{mqtt.CodeProtoError, 0, false},
+		{mqtt.CodePacketTooLarge, 0, false},
+	}
+
+	for _, c := range cases {
+		if got, ok := connAckCode(mqtt.V5, c.code); got != c.code || !ok {
+			t.Errorf("v5 %#x: got (%#x, %v), want (%#x, true)", c.code, got, ok, c.code)
+		}
+		if got, ok := connAckCode(mqtt.V311, c.code); got != c.v3 || ok != c.v3Reply {
+			t.Errorf("v3 %#x: got (%#x, %v), want (%#x, %v)", c.code, got, ok, c.v3, c.v3Reply)
+		}
+	}
+}
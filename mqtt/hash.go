@@ -0,0 +1,208 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// password hash methods, pbkdf2 hashes are formatted as
+// "$pbkdf2-sha256$i=<iterations>$<salt>$<hash>"
+const (
+	HashPBKDF2   = "pbkdf2-sha256"
+	HashBcrypt   = "bcrypt"
+	HashArgon2ID = "argon2id"
+)
+
+const (
+	pbkdf2Iterations = 100000
+	pbkdf2SaltLen    = 16
+	pbkdf2KeyLen     = sha256.Size
+)
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var errBadHash = errors.New("malformed password hash")
+
+// passwordHasher creates and verifies password hashes of one method
+type passwordHasher struct {
+	hash   func(password []byte) (string, error)
+	verify func(hash string, password []byte) (bool, error)
+}
+
+var bcryptHasher = passwordHasher{hash: hashBcrypt, verify: verifyBcrypt}
+
+// password hash methods by id, the first field of hashes, bcrypt hashes
+// are identified by their version
+var passwordHashers = map[string]passwordHasher{
+	HashPBKDF2:   {hash: hashPBKDF2, verify: verifyPBKDF2},
+	HashArgon2ID: {hash: hashArgon2ID, verify: verifyArgon2ID},
+	HashBcrypt:   bcryptHasher,
+	"2a":         bcryptHasher,
+	"2b":         bcryptHasher,
+	"2y":         bcryptHasher,
+}
+
+// HashPassword hashes password with the hash method for password files
+func HashPassword(method string, password []byte) (string, error) {
+	h, ok := passwordHashers[method]
+	if !ok {
+		return "", fmt.Errorf("password hash method %q not supported", method)
+	}
+	return h.hash(password)
+}
+
+// verifyPassword checks password against hash with the method the hash
+// was created with
+func verifyPassword(hash string, password []byte) (bool, error) {
+	fields := strings.SplitN(hash, "$", 3)
+	if len(fields) < 3 || fields[0] != "" {
+		return false, errBadHash
+	}
+
+	h, ok := passwordHashers[fields[1]]
+	if !ok {
+		return false, fmt.Errorf("password hash method %q not supported", fields[1])
+	}
+	return h.verify(hash, password)
+}
+
+func hashPBKDF2(password []byte) (string, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key(password, salt, pbkdf2Iterations, pbkdf2KeyLen, sha256.New)
+	return fmt.Sprintf("$%s$i=%d$%s$%s", HashPBKDF2, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPBKDF2(hash string, password []byte) (bool, error) {
+	iter, salt, key, err := parsePBKDF2(hash)
+	if err != nil {
+		return false, err
+	}
+
+	derived := pbkdf2.Key(password, salt, iter, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// parsePBKDF2 returns iterations, salt and derived key of pbkdf2 hash
+func parsePBKDF2(hash string) (int, []byte, []byte, error) {
+	// "", method, "i=<iterations>", salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[1] != HashPBKDF2 || !strings.HasPrefix(fields[2], "i=") {
+		return 0, nil, nil, errBadHash
+	}
+
+	iter, err := strconv.Atoi(strings.TrimPrefix(fields[2], "i="))
+	if err != nil || iter <= 0 {
+		return 0, nil, nil, errBadHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return 0, nil, nil, errBadHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errBadHash
+	}
+	return iter, salt, key, nil
+}
+
+func hashBcrypt(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func verifyBcrypt(hash string, password []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hashArgon2ID creates hash formatted as
+// "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>"
+func hashArgon2ID(password []byte) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(password, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", HashArgon2ID, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyArgon2ID(hash string, password []byte) (bool, error) {
+	// "", method, version, params, salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return false, errBadHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errBadHash
+	}
+
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errBadHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, errBadHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return false, errBadHash
+	}
+
+	derived := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
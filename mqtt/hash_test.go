@@ -0,0 +1,76 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import "testing"
+
+func TestVerifyPassword(t *testing.T) {
+	cases := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+		err      bool
+	}{
+		{"pbkdf2", "$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$tiKWHy4FAGCWE8gn6GtKhaxD2OeeAUUWXFT/p1aaNl8", "secret", true, false},
+		{"pbkdf2 mismatch", "$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$tiKWHy4FAGCWE8gn6GtKhaxD2OeeAUUWXFT/p1aaNl8", "Secret", false, false},
+		{"bcrypt", "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "allmine", true, false},
+		{"bcrypt mismatch", "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "allyours", false, false},
+		{"argon2id", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7", "password", true, false},
+		{"argon2id mismatch", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7", "passw0rd", false, false},
+		{"plain", "secret", "secret", false, true},
+		{"unknown method", "$md5$salt$hash", "secret", false, true},
+		{"pbkdf2 no iterations", "$pbkdf2-sha256$MDEyMzQ1Njc4OWFiY2RlZg$tiKWHy4FAGCWE8gn6GtKhaxD2OeeAUUWXFT/p1aaNl8", "secret", false, true},
+		{"pbkdf2 zero iterations", "$pbkdf2-sha256$i=0$MDEyMzQ1Njc4OWFiY2RlZg$tiKWHy4FAGCWE8gn6GtKhaxD2OeeAUUWXFT/p1aaNl8", "secret", false, true},
+		{"pbkdf2 bad salt", "$pbkdf2-sha256$i=1000$!$tiKWHy4FAGCWE8gn6GtKhaxD2OeeAUUWXFT/p1aaNl8", "secret", false, true},
+		{"pbkdf2 empty key", "$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$", "secret", false, true},
+		{"bcrypt short", "$2a$10$fooo", "secret", false, true},
+		{"argon2id bad version", "$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7", "password", false, true},
+		{"argon2id bad params", "$argon2id$v=19$m=64$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7", "password", false, true},
+	}
+
+	for _, c := range cases {
+		ok, err := verifyPassword(c.hash, []byte(c.password))
+		if (err != nil) != c.err {
+			t.Errorf("%s: got err %v, want err %v", c.name, err, c.err)
+		}
+		if ok != c.ok {
+			t.Errorf("%s: got %v, want %v", c.name, ok, c.ok)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, method := range []string{HashPBKDF2, HashBcrypt, HashArgon2ID} {
+		hash, err := HashPassword(method, []byte("secret"))
+		if err != nil {
+			t.Errorf("%s: hash: %v", method, err)
+			continue
+		}
+
+		if ok, err := verifyPassword(hash, []byte("secret")); !ok || err != nil {
+			t.Errorf("%s: verify %q got %v, %v, want true, nil", method, hash, ok, err)
+		}
+		if ok, err := verifyPassword(hash, []byte("wrong")); ok || err != nil {
+			t.Errorf("%s: verify wrong password got %v, %v, want false, nil", method, ok, err)
+		}
+	}
+
+	if _, err := HashPassword("md5", []byte("secret")); err == nil {
+		t.Errorf("md5: got nil err, want not supported")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"sort"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+// max inflight messages allowed by packet id space
+const maxInflight = 0xffff
+
+// states of outbound qos 1 and qos 2 messages
+const (
+	stateWaitAck  = iota // qos 1 publish sent, waiting for puback
+	stateWaitRec         // qos 2 publish sent, waiting for pubrec
+	stateWaitComp        // qos 2 pubrel sent, waiting for pubcomp
+)
+
+type inflightMsg struct {
+	seq   uint64              // order of message entering session
+	state int                 // delivery state
+	sent  bool                // sent to client at least once
+	pkt   *mqtt.PublishPacket // message, packet id assigned when inflight
+}
+
+// inflight tracks outbound qos 1 and qos 2 messages of one session
+// until they are acknowledged, messages exceeding the window are
+// queued and sent when acknowledgements arrive
+type inflight struct {
+	msgs   map[uint16]*inflightMsg
+	queue  []*inflightMsg
+	held   []*inflightMsg // inflight messages to resend when window has room
+	window int
+	lastID uint16
+	seq    uint64
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		msgs:   make(map[uint16]*inflightMsg),
+		window: maxInflight,
+	}
+}
+
+// push message into inflight window and assign packet id, sent tells
+// whether it is going to be sent to client immediately, return false
+// if the window is full and message has been queued
+func (f *inflight) push(pkt *mqtt.PublishPacket, sent bool) (*inflightMsg, bool) {
+	f.seq++
+	msg := &inflightMsg{seq: f.seq, pkt: pkt}
+	if len(f.msgs) >= f.window {
+		f.queue = append(f.queue, msg)
+		return msg, false
+	}
+
+	f.enter(msg, sent)
+	return msg, true
+}
+
+// release held messages while inflight window has room, return packets
+// to resend
+func (f *inflight) release() []mqtt.Packet {
+	var result []mqtt.Packet
+	for len(f.held) > 0 && len(f.msgs)-len(f.held) < f.window {
+		msg := f.held[0]
+		f.held[0] = nil
+		f.held = f.held[1:]
+		result = append(result, f.resend(msg))
+	}
+	return result
+}
+
+// pop queued messages into inflight window while it has room
+func (f *inflight) pop(sent bool) []*inflightMsg {
+	var result []*inflightMsg
+	for len(f.queue) > 0 && len(f.msgs) < f.window {
+		msg := f.queue[0]
+		f.queue[0] = nil
+		f.queue = f.queue[1:]
+		f.enter(msg, sent)
+		result = append(result, msg)
+	}
+	return result
+}
+
+func (f *inflight) enter(msg *inflightMsg, sent bool) {
+	msg.pkt.PacketID = f.nextID()
+	msg.state = stateWaitAck
+	if msg.pkt.Qos == mqtt.Qos2 {
+		msg.state = stateWaitRec
+	}
+	msg.sent = sent
+	f.msgs[msg.pkt.PacketID] = msg
+}
+
+// restore message loaded from persist storage, id is the packet id of
+// inflight message or 0 for queued message
+func (f *inflight) restore(msg *inflightMsg, id uint16) {
+	if msg.seq > f.seq {
+		f.seq = msg.seq
+	}
+
+	if id == 0 {
+		f.queue = append(f.queue, msg)
+		return
+	}
+
+	msg.pkt.PacketID = id
+	f.msgs[id] = msg
+}
+
+// sortQueue restores order of queued messages after loaded
+func (f *inflight) sortQueue() {
+	sort.Slice(f.queue, func(i, j int) bool { return f.queue[i].seq < f.queue[j].seq })
+}
+
+// nextID allocates a packet id not used by any inflight message,
+// the caller must make sure the window is not full
+func (f *inflight) nextID() uint16 {
+	for {
+		f.lastID++
+		if f.lastID == 0 {
+			f.lastID = 1
+		}
+
+		if _, used := f.msgs[f.lastID]; !used {
+			return f.lastID
+		}
+	}
+}
+
+// ack moves message in expected state to next state,
+// remove it from window when its delivery has been completed
+func (f *inflight) ack(id uint16, expected int) bool {
+	msg, ok := f.msgs[id]
+	if !ok || msg.state != expected {
+		return false
+	}
+
+	if expected == stateWaitRec {
+		msg.state = stateWaitComp
+	} else {
+		f.remove(msg)
+	}
+	return true
+}
+
+// drop message regardless of its state
+func (f *inflight) drop(id uint16) {
+	if msg, ok := f.msgs[id]; ok {
+		f.remove(msg)
+	}
+}
+
+func (f *inflight) remove(msg *inflightMsg) {
+	delete(f.msgs, msg.pkt.PacketID)
+	for i, m := range f.held {
+		if m == msg {
+			f.held = append(f.held[:i], f.held[i+1:]...)
+			break
+		}
+	}
+}
+
+// pending packets to send when session resumed, publish packets sent
+// before are marked as duplicate, qos 2 messages already received are
+// continued with pubrel, messages exceeding the window are held until
+// acknowledgements arrive
+func (f *inflight) pending() []mqtt.Packet {
+	msgs := make([]*inflightMsg, 0, len(f.msgs))
+	for _, msg := range f.msgs {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+
+	f.held = nil
+	if len(msgs) > f.window {
+		f.held = msgs[f.window:]
+		msgs = msgs[:f.window]
+	}
+
+	result := make([]mqtt.Packet, 0, len(msgs))
+	for _, msg := range msgs {
+		result = append(result, f.resend(msg))
+	}
+	return result
+}
+
+// resend returns packet to continue delivery of inflight message
+func (f *inflight) resend(msg *inflightMsg) mqtt.Packet {
+	if msg.state == stateWaitComp {
+		return &mqtt.PubRelPacket{PacketID: msg.pkt.PacketID}
+	}
+
+	pkt := *msg.pkt
+	pkt.IsDup = msg.sent
+	msg.sent = true
+	return &pkt
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+func TestInflightWindow(t *testing.T) {
+	f := newInflight()
+	f.window = 2
+
+	var ids []uint16
+	for i := 0; i < 3; i++ {
+		msg, ok := f.push(&mqtt.PublishPacket{TopicName: "a", Qos: mqtt.Qos1}, true)
+		if ok != (i < 2) {
+			t.Errorf("push %d: got %v, want %v", i, ok, i < 2)
+		}
+		ids = append(ids, msg.pkt.PacketID)
+	}
+
+	if len(f.msgs) != 2 || len(f.queue) != 1 || ids[2] != 0 {
+		t.Fatalf("got %d inflight, %d queued, queued id %d, want 2, 1, 0", len(f.msgs), len(f.queue), ids[2])
+	}
+
+	if msgs := f.pop(true); len(msgs) != 0 {
+		t.Errorf("pop full window: got %d messages", len(msgs))
+	}
+	if !f.ack(ids[0], stateWaitAck) || f.ack(ids[0], stateWaitAck) {
+		t.Errorf("ack %d: got not acked or acked twice", ids[0])
+	}
+	if msgs := f.pop(true); len(msgs) != 1 || msgs[0].pkt.PacketID == 0 || msgs[0].pkt.PacketID == ids[1] {
+		t.Errorf("pop: got %d messages, want 1 with new packet id", len(msgs))
+	}
+}
+
+func TestInflightPendingHeld(t *testing.T) {
+	f := newInflight()
+	var ids []uint16
+	for i := 0; i < 4; i++ {
+		msg, _ := f.push(&mqtt.PublishPacket{TopicName: "a", Qos: mqtt.Qos2}, i != 3)
+		ids = append(ids, msg.pkt.PacketID)
+	}
+	f.ack(ids[1], stateWaitRec)
+
+	// resumed with smaller receive maximum
+	f.window = 2
+	pending := f.pending()
+	if len(pending) != 2 {
+		t.Fatalf("pending: got %d packets, want 2", len(pending))
+	}
+	if p, ok := pending[0].(*mqtt.PublishPacket); !ok || p.PacketID != ids[0] || !p.IsDup {
+		t.Errorf("pending 0: got %+v, want duplicate publish %d", pending[0], ids[0])
+	}
+	if p, ok := pending[1].(*mqtt.PubRelPacket); !ok || p.PacketID != ids[1] {
+		t.Errorf("pending 1: got %+v, want pubrel %d", pending[1], ids[1])
+	}
+
+	if pkts := f.release(); len(pkts) != 0 {
+		t.Errorf("release full window: got %d packets", len(pkts))
+	}
+	if _, ok := f.push(&mqtt.PublishPacket{TopicName: "b", Qos: mqtt.Qos1}, true); ok {
+		t.Error("push with held messages: got sent, want queued")
+	}
+
+	// held message acknowledged anyway is not resent
+	f.ack(ids[2], stateWaitRec)
+	f.ack(ids[2], stateWaitComp)
+	f.ack(ids[0], stateWaitRec)
+	f.ack(ids[0], stateWaitComp)
+
+	pkts := f.release()
+	if len(pkts) != 1 {
+		t.Fatalf("release: got %d packets, want 1", len(pkts))
+	}
+	// never sent before, not duplicate
+	if p, ok := pkts[0].(*mqtt.PublishPacket); !ok || p.PacketID != ids[3] || p.IsDup {
+		t.Errorf("release: got %+v, want publish %d", pkts[0], ids[3])
+	}
+	if len(f.held) != 0 || len(f.msgs) != 2 {
+		t.Errorf("got %d held, %d inflight, want 0, 2", len(f.held), len(f.msgs))
+	}
+	if msgs := f.pop(true); len(msgs) != 0 {
+		t.Errorf("pop full window: got %d messages", len(msgs))
+	}
+}
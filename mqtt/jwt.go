@@ -0,0 +1,433 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// json web token signing algorithms supported
+const (
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgHS256 = "HS256"
+)
+
+// default claims of client identity and permissions
+const (
+	defaultJWTClientIDClaim  = "client_id"
+	defaultJWTUsernameClaim  = "sub"
+	defaultJWTPublishClaim   = "publish"
+	defaultJWTSubscribeClaim = "subscribe"
+)
+
+// clock skew allowed checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+var (
+	errBadJWT       = errors.New("malformed json web token")
+	errBadJWTSig    = errors.New("invalid json web token signature")
+	errJWTExpired   = errors.New("json web token expired or not valid yet")
+	errBadJWTAud    = errors.New("json web token audience mismatch")
+	errBadJWK       = errors.New("invalid json web key")
+	errBadJWTKeyPEM = errors.New("no public key found in pem file")
+)
+
+// JWTAuth is an Authenticator of json web tokens sent as password,
+// tokens signed with RS256, ES256 or HS256 are verified with keys in
+// jwks file, public key files and hmac secret
+//
+// client id and username are replaced by the claims if present, topic
+// filters in publish and subscribe claims (string arrays) restrict what
+// the client can do, with "%u" and "%c" replaced as in ACLFile, actions
+// without claim are denied once any of them is present, the connection
+// is closed when the token expires
+type JWTAuth struct {
+	Audience       string // required audience, not checked if empty
+	ClientIDClaim  string // "client_id" if not set
+	UsernameClaim  string // "sub" if not set
+	PublishClaim   string // "publish" if not set
+	SubscribeClaim string // "subscribe" if not set
+
+	jwksFile string
+	keyFiles []string
+	secret   []byte
+
+	mu   sync.RWMutex
+	keys []jwtKey
+}
+
+type jwtKey struct {
+	id  string      // key id, matches any token if empty
+	alg string      // algorithm the key is used for
+	key interface{} // *rsa.PublicKey, *ecdsa.PublicKey or []byte
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk is a key of json web key set, only public keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWTAuth loads keys to verify tokens, from jwks file and pem encoded
+// public key or certificate files, secret is the key of HS256
+func LoadJWTAuth(jwksFile string, keyFiles []string, secret []byte) (*JWTAuth, error) {
+	a := &JWTAuth{jwksFile: jwksFile, keyFiles: keyFiles, secret: secret}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads key files again, keys loaded are kept if any fails
+func (a *JWTAuth) Reload() error {
+	var keys []jwtKey
+	if len(a.secret) > 0 {
+		keys = append(keys, jwtKey{alg: JWTAlgHS256, key: a.secret})
+	}
+
+	for _, file := range a.keyFiles {
+		key, err := loadJWTKeyFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+		keys = append(keys, key)
+	}
+
+	if a.jwksFile != "" {
+		set, err := loadJWKS(a.jwksFile)
+		if err != nil {
+			return fmt.Errorf("%s: %s", a.jwksFile, err.Error())
+		}
+		keys = append(keys, set...)
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate verifies token in password and applies its claims
+func (a *JWTAuth) Authenticate(info *AuthInfo) error {
+	claims, err := a.verify(string(info.Password), time.Now())
+	if err != nil {
+		return ErrBadCredentials
+	}
+
+	if id, ok := claims[claimName(a.ClientIDClaim, defaultJWTClientIDClaim)].(string); ok && id != "" {
+		info.ClientID = id
+	}
+
+	if user, ok := claims[claimName(a.UsernameClaim, defaultJWTUsernameClaim)].(string); ok && user != "" {
+		info.Username = user
+	}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		// same leeway as verify, or tokens accepted expire immediately
+		info.Expiry = time.Unix(int64(exp), 0).Add(jwtLeeway)
+	}
+
+	pub, hasPub := claims[claimName(a.PublishClaim, defaultJWTPublishClaim)]
+	sub, hasSub := claims[claimName(a.SubscribeClaim, defaultJWTSubscribeClaim)]
+	if hasPub || hasSub {
+		perms := &jwtPerms{}
+		if perms.publish, err = stringArray(pub, hasPub); err != nil {
+			return ErrBadCredentials
+		}
+		if perms.subscribe, err = stringArray(sub, hasSub); err != nil {
+			return ErrBadCredentials
+		}
+		info.ACL = perms
+	}
+	return nil
+}
+
+// verify token signature and time claims, return claims of the token
+func (a *JWTAuth) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errBadJWT
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadJWT
+	}
+
+	if !a.verifySig(&header, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errBadJWTSig
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errJWTExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errJWTExpired
+	}
+
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return nil, errBadJWTAud
+	}
+	return claims, nil
+}
+
+// verifySig checks signature with keys of the algorithm and key id
+func (a *JWTAuth) verifySig(header *jwtHeader, signed, sig []byte) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	digest := sha256.Sum256(signed)
+	for _, k := range a.keys {
+		if k.alg != header.Alg || k.id != "" && k.id != header.Kid {
+			continue
+		}
+
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			// r and s of 32 bytes each
+			if len(sig) == 64 && ecdsa.Verify(key, digest[:],
+				new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return true
+			}
+		case []byte:
+			mac := hmac.New(sha256.New, key)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtPerms is the acl of client from publish and subscribe claims
+type jwtPerms struct {
+	publish, subscribe []string
+}
+
+func (p *jwtPerms) Authorize(info *AuthInfo, action ACLAction, topic string) bool {
+	filters := p.publish
+	if action == ACLSubscribe {
+		filters = p.subscribe
+	}
+
+	for _, f := range filters {
+		filter, ok := expandACLFilter(f, info)
+		if ok && aclMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errBadJWT
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errBadJWT
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringArray(v interface{}, present bool) ([]string, error) {
+	if !present {
+		return nil, nil
+	}
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errBadJWT
+	}
+
+	result := make([]string, 0, len(arr))
+	for _, s := range arr {
+		str, ok := s.(string)
+		if !ok || !validTopicFilter(str) {
+			return nil, errBadJWT
+		}
+		result = append(result, str)
+	}
+	return result, nil
+}
+
+func claimName(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// loadJWTKeyFile loads rsa or ecdsa public key from pem encoded public
+// key or certificate
+func loadJWTKeyFile(file string) (jwtKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return jwtKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return jwtKey{}, errBadJWTKeyPEM
+	}
+
+	var pub interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		pub = cert.PublicKey
+	default:
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return jwtKey{}, err
+		}
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return jwtKey{alg: JWTAlgRS256, key: key}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return jwtKey{}, errBadJWTKeyPEM
+		}
+		return jwtKey{alg: JWTAlgES256, key: key}, nil
+	default:
+		return jwtKey{}, errBadJWTKeyPEM
+	}
+}
+
+// loadJWKS loads keys of json web key set
+func loadJWKS(file string) ([]jwtKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", k.Kid, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k *jwk) parse() (jwtKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, errBadJWK
+		}
+		return jwtKey{id: k.Kid, alg: JWTAlgRS256, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}}, nil
+	case "EC":
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if k.Crv != "P-256" || err1 != nil || err2 != nil {
+			return jwtKey{}, errBadJWK
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return jwtKey{}, errBadJWK
+		}
+		return jwtKey{id: k.Kid, alg: JWTAlgES256, key: key}, nil
+	case "oct":
+		secret, err := b64.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return jwtKey{}, errBadJWK
+		}
+		return jwtKey{id: k.Kid, alg: JWTAlgHS256, key: secret}, nil
+	default:
+		return jwtKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var jwtTestSecret = []byte("secret")
+
+// signHS256 creates token of claims signed with jwtTestSecret
+func signHS256(t *testing.T, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": JWTAlgHS256, "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, jwtTestSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthExpiry(t *testing.T) {
+	a, err := LoadJWTAuth("", nil, jwtTestSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	cases := []struct {
+		name string
+		exp  time.Time
+		err  error
+	}{
+		{"valid", now.Add(time.Minute), nil},
+		{"expired within leeway", now.Add(-jwtLeeway / 2), nil},
+		{"expired", now.Add(-2 * jwtLeeway), ErrBadCredentials},
+	}
+
+	for _, c := range cases {
+		info := &AuthInfo{Password: []byte(signHS256(t, map[string]interface{}{"sub": "alice", "exp": c.exp.Unix()}))}
+		if err := a.Authenticate(info); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if c.err != nil {
+			continue
+		}
+
+		// the connection must outlive the token as long as it is accepted
+		if want := c.exp.Add(jwtLeeway); !info.Expiry.Equal(want) {
+			t.Errorf("%s: got expiry %v, want %v", c.name, info.Expiry, want)
+		}
+		if !info.Expiry.After(time.Now()) {
+			t.Errorf("%s: accepted token expires immediately at %v", c.name, info.Expiry)
+		}
+	}
+
+	info := &AuthInfo{Password: []byte(signHS256(t, map[string]interface{}{"sub": "alice"}))}
+	if err := a.Authenticate(info); err != nil || !info.Expiry.IsZero() {
+		t.Errorf("no exp: got %v with expiry %v, want nil without expiry", err, info.Expiry)
+	}
+}
+
+func TestJWTAuthClaims(t *testing.T) {
+	a, err := LoadJWTAuth("", nil, jwtTestSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &AuthInfo{ClientID: "c0", Username: "u0", Password: []byte(signHS256(t, map[string]interface{}{
+		"client_id": "c1",
+		"sub":       "alice",
+		"publish":   []string{"users/%u/#"},
+	}))}
+	if err := a.Authenticate(info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ClientID != "c1" || info.Username != "alice" {
+		t.Errorf("got client id %q, username %q, want %q, %q", info.ClientID, info.Username, "c1", "alice")
+	}
+	if info.ACL == nil {
+		t.Fatal("got nil acl with publish claim")
+	}
+
+	cases := []struct {
+		action ACLAction
+		topic  string
+		want   bool
+	}{
+		{ACLPublish, "users/alice/x", true},
+		{ACLPublish, "users/bob/x", false},
+		// denied without subscribe claim
+		{ACLSubscribe, "users/alice/x", false},
+	}
+	for _, c := range cases {
+		if got := info.ACL.Authorize(info, c.action, c.topic); got != c.want {
+			t.Errorf("%v %q: got %v, want %v", c.action, c.topic, got, c.want)
+		}
+	}
+
+	// bad signature
+	token := signHS256(t, map[string]interface{}{"sub": "alice"})
+	if err := a.Authenticate(&AuthInfo{Password: []byte(token + "x")}); err != ErrBadCredentials {
+		t.Errorf("bad signature: got %v, want %v", err, ErrBadCredentials)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// time allowed for refused client to send its connect packet
+const refuseTimeout = 5 * time.Second
+
+// max connections answered with connack at the same time when refused,
+// connections refused beyond it are closed at once
+const maxRefusing = 64
+
+func (s *Server) initLimits() {
+	s.connLimit = newLimiter(s.log, "all", s.opts.MaxConn, nil)
+	s.tcpLimit = newLimiter(s.log, "tcp", s.opts.MaxTCP, s.connLimit)
+	s.tcpsLimit = newLimiter(s.log, "tcps", s.opts.MaxTCPS, s.connLimit)
+	s.wsLimit = newLimiter(s.log, "ws", s.opts.MaxWS, s.connLimit)
+	s.wssLimit = newLimiter(s.log, "wss", s.opts.MaxWSS, s.connLimit)
+	s.refusing = make(chan struct{}, maxRefusing)
+}
+
+// limiter counts connections against max connections allowed,
+// connections are also counted by parent limiter if any
+type limiter struct {
+	log    *zap.Logger
+	name   string
+	max    int64 // 0 means no limit
+	count  int64
+	parent *limiter
+}
+
+func newLimiter(log *zap.Logger, name string, max int, parent *limiter) *limiter {
+	return &limiter{log: log, name: name, max: int64(max), parent: parent}
+}
+
+// acquire a connection slot, return false if limit reached
+func (l *limiter) acquire() bool {
+	n := atomic.AddInt64(&l.count, 1)
+	if l.max > 0 && n > l.max {
+		atomic.AddInt64(&l.count, -1)
+		l.log.Warn("connection limit reached", zap.String("listener", l.name), zap.Int64("max", l.max))
+		return false
+	}
+
+	if l.parent != nil && !l.parent.acquire() {
+		atomic.AddInt64(&l.count, -1)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) release() {
+	atomic.AddInt64(&l.count, -1)
+	if l.parent != nil {
+		l.parent.release()
+	}
+}
+
+// limit wraps connection to release its slot when closed
+func (l *limiter) limit(conn net.Conn) net.Conn {
+	return &limitedConn{Conn: conn, limiter: l}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *limiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.limiter.release)
+	return c.Conn.Close()
+}
+
+// refuse connection exceeding connection limit, it's answered in
+// background if there is a free refusing slot and closed at once
+// otherwise, so that refused clients can't hold many connections open
+func (s *Server) refuse(conn net.Conn) {
+	select {
+	case s.refusing <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.refusing }()
+		refuseConn(conn)
+	}()
+}
+
+// refuseConn answers connect packet of client exceeding connection
+// limit with connack of server unavailable (mqtt 3.1.1) or quota
+// exceeded (mqtt 5) and closes the connection
+func refuseConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(refuseTimeout))
+	connRW := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	version, err := peekVersion(connRW.Reader)
+	if err != nil {
+		return
+	}
+
+	if version != mqtt.V5 {
+		version = mqtt.V311
+	}
+
+	code, _ := connAckCode(version, mqtt.CodeQuotaExceeded)
+	writePacket(connRW, version, &mqtt.ConnAckPacket{Code: code}, 0)
+}
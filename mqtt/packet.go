@@ -0,0 +1,1086 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+// properties of mqtt 5
+const (
+	propPayloadFormat   = 0x01
+	propMessageExpiry   = 0x02
+	propContentType     = 0x03
+	propRespTopic       = 0x08
+	propCorrelationData = 0x09
+	propSubID           = 0x0b
+	propSessionExpiry   = 0x11
+	propAssignedID      = 0x12
+	propServerKeepalive = 0x13
+	propAuthMethod      = 0x15
+	propAuthData        = 0x16
+	propReqProblemInfo  = 0x17
+	propWillDelay       = 0x18
+	propReqRespInfo     = 0x19
+	propRespInfo        = 0x1a
+	propServerRef       = 0x1c
+	propReasonString    = 0x1f
+	propMaxRecv         = 0x21
+	propMaxTopicAlias   = 0x22
+	propTopicAlias      = 0x23
+	propUserProps       = 0x26
+	propMaxPacketSize   = 0x27
+	propSubIDAvail      = 0x29
+	propSharedSubAvail  = 0x2a
+)
+
+// max size of packet allowed by remaining length
+const maxPacketSize = 268435460
+
+var errPacketTooLarge = errors.New("packet exceeds maximum packet size")
+
+// unSubAckPacket carries reason codes of unsuback (mqtt 5),
+// which are missing in libmqtt
+type unSubAckPacket struct {
+	mqtt.UnSubAckPacket
+	Codes []byte
+}
+
+// subscribePacket carries subscription options of mqtt 5, of which
+// libmqtt only keeps the maximum qos
+type subscribePacket struct {
+	mqtt.SubscribePacket
+	Options []subOptions // options of topic filters in order
+}
+
+// readPacket reads one packet from client, publish packets and mqtt 5
+// packets are decoded here since libmqtt rejects publish packet with
+// payload shorter than 2 bytes and fails with properties of mqtt 5
+// packets or their short forms, packet larger than maxSize is refused
+// before its body is read, 0 means no limit
+func readPacket(version mqtt.ProtoVersion, r *bufio.Reader, maxSize int) (mqtt.Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readRemainLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && packetSize(length) > maxSize {
+		return nil, errPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if version == mqtt.V5 {
+		return decodeV5(header, body)
+	}
+
+	if mqtt.CtrlType(header>>4) == mqtt.CtrlPublish {
+		return decodePublish(version, header, body)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(header)
+	writeRemainLength(buf, length)
+	buf.Write(body)
+	return decodePacket(version, buf)
+}
+
+func readRemainLength(r io.ByteReader) (int, error) {
+	length, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		shift += 7
+	}
+	return 0, errBadRemainLength
+}
+
+// packetSize returns size of packet including its fixed header
+func packetSize(length int) int {
+	size := 2 + length
+	for n := length; n >= 128; n /= 128 {
+		size++
+	}
+	return size
+}
+
+func writeRemainLength(w io.ByteWriter, length int) {
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if length == 0 {
+			return
+		}
+	}
+}
+
+// readConnect reads the connect packet, will properties of mqtt 5
+// which libmqtt does not decode are kept with the will message
+func readConnect(version mqtt.ProtoVersion, r *bufio.Reader, maxSize int) (*mqtt.ConnPacket, *willMsg, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mqtt.CtrlType(header>>4) != mqtt.CtrlConn {
+		return nil, nil, errNotConnect
+	}
+
+	length, err := readRemainLength(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if maxSize > 0 && packetSize(length) > maxSize {
+		return nil, nil, errPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	return decodeConnect(version, body)
+}
+
+func decodeConnect(version mqtt.ProtoVersion, body []byte) (*mqtt.ConnPacket, *willMsg, error) {
+	d := &propReader{data: body}
+	pkt := &mqtt.ConnPacket{ProtoName: d.string()}
+	pkt.ProtoVersion = mqtt.ProtoVersion(d.byte())
+	flags := d.byte()
+	pkt.Keepalive = d.uint16()
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+
+	if flags&0x01 != 0 {
+		// reserved flag must be zero
+		return nil, nil, mqtt.ErrDecodeBadPacket
+	}
+
+	pkt.CleanSession = flags&0x02 == 0x02
+	pkt.IsWill = flags&0x04 == 0x04
+	pkt.WillQos = flags & 0x18 >> 3
+	pkt.WillRetain = flags&0x20 == 0x20
+
+	if version == mqtt.V5 {
+		pkt.Props = &mqtt.ConnProps{}
+		if err := d.props(func(id byte) bool { return setConnProp(pkt.Props, id, d) }); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pkt.ClientID = d.string()
+
+	var will *willMsg
+	if pkt.IsWill {
+		will = &willMsg{pkt: &mqtt.PublishPacket{
+			Qos:      pkt.WillQos,
+			IsRetain: pkt.WillRetain,
+		}}
+
+		if version == mqtt.V5 {
+			will.pkt.Props = &mqtt.PublishProps{}
+			if err := d.props(func(id byte) bool {
+				if id == propWillDelay {
+					will.delay = d.uint32()
+					return true
+				}
+				return id != propTopicAlias && id != propSubID && setPublishProp(will.pkt.Props, id, d)
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		pkt.WillTopic = d.string()
+		pkt.WillMessage = d.binary()
+		will.pkt.TopicName = pkt.WillTopic
+		will.pkt.Payload = pkt.WillMessage
+	}
+
+	if flags&0x80 == 0x80 {
+		pkt.Username = d.string()
+	}
+
+	if flags&0x40 == 0x40 {
+		pkt.Password = string(d.binary())
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+
+	if len(d.data) != 0 {
+		return nil, nil, mqtt.ErrDecodeBadPacket
+	}
+
+	return pkt, will, nil
+}
+
+// decodeV5 decodes mqtt 5 packets sent by client
+func decodeV5(header byte, body []byte) (mqtt.Packet, error) {
+	ctrl, flags := mqtt.CtrlType(header>>4), header&0x0f
+	switch ctrl {
+	case mqtt.CtrlPublish:
+		return decodePublish(mqtt.V5, header, body)
+	case mqtt.CtrlPubRel, mqtt.CtrlSubscribe, mqtt.CtrlUnSub:
+		if flags != 0x02 {
+			return nil, mqtt.ErrDecodeBadPacket
+		}
+	default:
+		if flags != 0 {
+			return nil, mqtt.ErrDecodeBadPacket
+		}
+	}
+
+	d := &propReader{data: body}
+	var pkt mqtt.Packet
+	switch ctrl {
+	case mqtt.CtrlConn:
+		connPkt, _, err := decodeConnect(mqtt.V5, body)
+		return connPkt, err
+	case mqtt.CtrlPubAck:
+		p := &mqtt.PubAckPacket{PacketID: d.uint16(), Props: &mqtt.PubAckProps{}}
+		p.Code = d.ack(&p.Props.Reason, &p.Props.UserProps)
+		pkt = p
+	case mqtt.CtrlPubRecv:
+		p := &mqtt.PubRecvPacket{PacketID: d.uint16(), Props: &mqtt.PubRecvProps{}}
+		p.Code = d.ack(&p.Props.Reason, &p.Props.UserProps)
+		pkt = p
+	case mqtt.CtrlPubRel:
+		p := &mqtt.PubRelPacket{PacketID: d.uint16(), Props: &mqtt.PubRelProps{}}
+		p.Code = d.ack(&p.Props.Reason, &p.Props.UserProps)
+		pkt = p
+	case mqtt.CtrlPubComp:
+		p := &mqtt.PubCompPacket{PacketID: d.uint16(), Props: &mqtt.PubCompProps{}}
+		p.Code = d.ack(&p.Props.Reason, &p.Props.UserProps)
+		pkt = p
+	case mqtt.CtrlSubscribe:
+		p := &subscribePacket{SubscribePacket: mqtt.SubscribePacket{PacketID: d.uint16(), Props: &mqtt.SubscribeProps{}}}
+		d.props(func(id byte) bool {
+			switch id {
+			case propSubID:
+				p.Props.SubID = uint32(d.varint())
+			case propUserProps:
+				p.Props.UserProps = d.userProp(p.Props.UserProps)
+			default:
+				return false
+			}
+			return true
+		})
+		for len(d.data) > 0 && d.err == nil {
+			name, opts := d.string(), subOptions(d.byte())
+			if opts&0xc0 != 0 || opts.retainHandling() > retainNever {
+				// reserved bits of subscription options
+				return nil, mqtt.ErrDecodeBadPacket
+			}
+			p.Topics = append(p.Topics, &mqtt.Topic{Name: name, Qos: opts.qos()})
+			p.Options = append(p.Options, opts)
+		}
+		pkt = p
+	case mqtt.CtrlUnSub:
+		p := &mqtt.UnSubPacket{PacketID: d.uint16(), Props: &mqtt.UnSubProps{}}
+		d.props(func(id byte) bool {
+			if id != propUserProps {
+				return false
+			}
+			p.Props.UserProps = d.userProp(p.Props.UserProps)
+			return true
+		})
+		for len(d.data) > 0 && d.err == nil {
+			p.TopicNames = append(p.TopicNames, d.string())
+		}
+		pkt = p
+	case mqtt.CtrlPingReq:
+		pkt = mqtt.PingReqPacket
+	case mqtt.CtrlDisConn:
+		p := &mqtt.DisConnPacket{Props: &mqtt.DisConnProps{}}
+		if len(d.data) > 0 {
+			p.Code = d.byte()
+		}
+		if len(d.data) > 0 {
+			d.props(func(id byte) bool {
+				switch id {
+				case propSessionExpiry:
+					p.Props.SessionExpiryInterval = d.uint32()
+				case propServerRef:
+					p.Props.ServerRef = d.string()
+				default:
+					return d.reasonProp(id, &p.Props.Reason, &p.Props.UserProps)
+				}
+				return true
+			})
+		}
+		pkt = p
+	case mqtt.CtrlAuth:
+		p := &mqtt.AuthPacket{Props: &mqtt.AuthProps{}}
+		if len(d.data) > 0 {
+			p.Code = d.byte()
+		}
+		if len(d.data) > 0 {
+			d.props(func(id byte) bool {
+				switch id {
+				case propAuthMethod:
+					p.Props.AuthMethod = d.string()
+				case propAuthData:
+					p.Props.AuthData = d.binary()
+				default:
+					return d.reasonProp(id, &p.Props.Reason, &p.Props.UserProps)
+				}
+				return true
+			})
+		}
+		pkt = p
+	default:
+		// packets only sent by server
+		return nil, mqtt.ErrDecodeBadPacket
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if len(d.data) != 0 {
+		return nil, mqtt.ErrDecodeBadPacket
+	}
+	return pkt, nil
+}
+
+func decodePublish(version mqtt.ProtoVersion, header byte, body []byte) (*mqtt.PublishPacket, error) {
+	d := &propReader{data: body}
+	pkt := &mqtt.PublishPacket{
+		IsDup:     header&0x08 == 0x08,
+		Qos:       header & 0x06 >> 1,
+		IsRetain:  header&0x01 == 0x01,
+		TopicName: d.string(),
+	}
+	pkt.ProtoVersion = version
+
+	if pkt.Qos > mqtt.Qos0 {
+		pkt.PacketID = d.uint16()
+	}
+
+	if version == mqtt.V5 {
+		pkt.Props = &mqtt.PublishProps{}
+		if err := d.props(func(id byte) bool { return setPublishProp(pkt.Props, id, d) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	pkt.Payload = d.data
+	return pkt, nil
+}
+
+func setConnProp(props *mqtt.ConnProps, id byte, d *propReader) bool {
+	switch id {
+	case propSessionExpiry:
+		props.SessionExpiryInterval = d.uint32()
+	case propMaxRecv:
+		props.MaxRecv = d.uint16()
+	case propMaxPacketSize:
+		props.MaxPacketSize = d.uint32()
+	case propMaxTopicAlias:
+		props.MaxTopicAlias = d.uint16()
+	case propReqRespInfo:
+		props.ReqRespInfo = d.byte() == 1
+	case propReqProblemInfo:
+		props.ReqProblemInfo = d.byte() == 1
+	case propUserProps:
+		props.UserProps = d.userProp(props.UserProps)
+	case propAuthMethod:
+		props.AuthMethod = d.string()
+	case propAuthData:
+		props.AuthData = d.binary()
+	default:
+		return false
+	}
+	return true
+}
+
+func setPublishProp(props *mqtt.PublishProps, id byte, d *propReader) bool {
+	switch id {
+	case propPayloadFormat:
+		props.PayloadFormat = d.byte()
+	case propMessageExpiry:
+		props.MessageExpiryInterval = d.uint32()
+	case propTopicAlias:
+		props.TopicAlias = d.uint16()
+	case propContentType:
+		props.ContentType = d.string()
+	case propRespTopic:
+		props.RespTopic = d.string()
+	case propCorrelationData:
+		props.CorrelationData = d.binary()
+	case propSubID:
+		props.SubIDs = append(props.SubIDs, d.varint())
+	case propUserProps:
+		props.UserProps = d.userProp(props.UserProps)
+	default:
+		return false
+	}
+	return true
+}
+
+// propReader reads fields of packet body in order, the first error
+// is kept and makes all following reads return zero value
+type propReader struct {
+	data []byte
+	err  error
+}
+
+func (d *propReader) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.data) < n {
+		d.err = mqtt.ErrDecodeBadPacket
+		return nil
+	}
+
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *propReader) byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *propReader) uint16() uint16 {
+	if v := d.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *propReader) uint32() uint32 {
+	if v := d.next(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *propReader) varint() int {
+	if d.err != nil {
+		return 0
+	}
+
+	r := bytes.NewReader(d.data)
+	v, err := readRemainLength(r)
+	if err != nil {
+		d.err = mqtt.ErrDecodeBadPacket
+		return 0
+	}
+
+	d.data = d.data[len(d.data)-r.Len():]
+	return v
+}
+
+// binary reads length prefixed binary data
+func (d *propReader) binary() []byte {
+	return d.next(int(d.uint16()))
+}
+
+// string reads length prefixed utf-8 string
+func (d *propReader) string() string {
+	return string(d.binary())
+}
+
+func (d *propReader) userProp(props mqtt.UserProperties) mqtt.UserProperties {
+	k, v := d.string(), d.string()
+	if props == nil {
+		props = make(mqtt.UserProperties)
+	}
+	props[k] = append(props[k], v)
+	return props
+}
+
+// reasonProp reads reason string or user property
+func (d *propReader) reasonProp(id byte, reason *string, userProps *mqtt.UserProperties) bool {
+	switch id {
+	case propReasonString:
+		*reason = d.string()
+	case propUserProps:
+		*userProps = d.userProp(*userProps)
+	default:
+		return false
+	}
+	return true
+}
+
+// ack reads reason code and properties following packet id of
+// acknowledgement packets, both may be omitted on success
+func (d *propReader) ack(reason *string, userProps *mqtt.UserProperties) byte {
+	if len(d.data) == 0 {
+		return mqtt.CodeSuccess
+	}
+
+	code := d.byte()
+	if len(d.data) > 0 {
+		d.props(func(id byte) bool { return d.reasonProp(id, reason, userProps) })
+	}
+	return code
+}
+
+// props reads mqtt 5 properties, set is called with each property id
+// to read its value and returns false if the id is not expected
+func (d *propReader) props(set func(id byte) bool) error {
+	length := d.varint()
+	raw := d.next(length)
+	if d.err != nil {
+		return d.err
+	}
+
+	rest := d.data
+	d.data = raw
+	for len(d.data) > 0 && d.err == nil {
+		if !set(d.byte()) && d.err == nil {
+			d.err = mqtt.ErrDecodeBadPacket
+		}
+	}
+	d.data = rest
+	return d.err
+}
+
+// writePacket encodes packet with the protocol version and flushes it,
+// mqtt 5 packets are encoded here since libmqtt miscounts their length
+// and misplaces their properties, mqtt 5 packet larger than maxSize is
+// not written, 0 means no limit
+func writePacket(w *bufio.ReadWriter, version mqtt.ProtoVersion, pkt mqtt.Packet, maxSize int) error {
+	if version != mqtt.V5 {
+		if p, ok := pkt.(*unSubAckPacket); ok {
+			pkt = &p.UnSubAckPacket
+		}
+
+		setVersion(pkt, version)
+		if err := mqtt.Encode(pkt, w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	header, body, err := encodeV5(pkt)
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && packetSize(len(body)) > maxSize {
+		return errPacketTooLarge
+	}
+
+	w.WriteByte(header)
+	writeRemainLength(w, len(body))
+	w.Write(body)
+	return w.Flush()
+}
+
+// encodeV5 encodes mqtt 5 packets sent by server into fixed header
+// and the rest of packet, connect and subscribe packets are encoded
+// only to be persisted
+func encodeV5(pkt mqtt.Packet) (byte, []byte, error) {
+	e := &propWriter{}
+	header := byte(pkt.Type() << 4)
+
+	switch p := pkt.(type) {
+	case *mqtt.ConnPacket:
+		// will message and credentials are never persisted
+		e.string(p.ProtoName)
+		e.WriteByte(byte(mqtt.V5))
+		if p.CleanSession {
+			e.WriteByte(0x02)
+		} else {
+			e.WriteByte(0)
+		}
+		e.uint16(p.Keepalive)
+		e.props(connProps(p.Props))
+		e.string(p.ClientID)
+	case *mqtt.ConnAckPacket:
+		if p.Present {
+			e.WriteByte(1)
+		} else {
+			e.WriteByte(0)
+		}
+		e.WriteByte(p.Code)
+		e.props(connAckProps(p.Props))
+	case *mqtt.PublishPacket:
+		if p.IsDup {
+			header |= 0x08
+		}
+		header |= p.Qos << 1
+		if p.IsRetain {
+			header |= 0x01
+		}
+
+		e.string(p.TopicName)
+		if p.Qos > mqtt.Qos0 {
+			e.uint16(p.PacketID)
+		}
+		e.props(publishProps(p.Props))
+		e.Write(p.Payload)
+	case *mqtt.PubAckPacket:
+		e.ack(p.PacketID, p.Code, reasonProps(p.Props))
+	case *mqtt.PubRecvPacket:
+		e.ack(p.PacketID, p.Code, reasonProps(p.Props))
+	case *mqtt.PubRelPacket:
+		header |= 0x02
+		e.ack(p.PacketID, p.Code, reasonProps(p.Props))
+	case *mqtt.PubCompPacket:
+		e.ack(p.PacketID, p.Code, reasonProps(p.Props))
+	case *mqtt.SubscribePacket:
+		header |= 0x02
+		e.uint16(p.PacketID)
+		e.props(subscribeProps(p.Props))
+		for _, t := range p.Topics {
+			e.string(t.Name)
+			e.WriteByte(t.Qos)
+		}
+	case *subscribePacket:
+		header |= 0x02
+		e.uint16(p.PacketID)
+		e.props(subscribeProps(p.Props))
+		for i, t := range p.Topics {
+			e.string(t.Name)
+			e.WriteByte(byte(p.Options[i]))
+		}
+	case *mqtt.SubAckPacket:
+		e.uint16(p.PacketID)
+		e.props(reasonProps(p.Props))
+		e.Write(p.Codes)
+	case *unSubAckPacket:
+		e.uint16(p.PacketID)
+		e.props(reasonProps(p.Props))
+		e.Write(p.Codes)
+	case *mqtt.DisConnPacket:
+		e.WriteByte(p.Code)
+		e.props(disConnProps(p.Props))
+	case *mqtt.AuthPacket:
+		e.WriteByte(p.Code)
+		e.props(authProps(p.Props))
+	default:
+		if pkt != mqtt.PingRespPacket {
+			return 0, nil, mqtt.ErrEncodeBadPacket
+		}
+	}
+	return header, e.Bytes(), nil
+}
+
+func connProps(props *mqtt.ConnProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.SessionExpiryInterval != 0 {
+		e.WriteByte(propSessionExpiry)
+		e.uint32(props.SessionExpiryInterval)
+	}
+	if props.MaxRecv != 0 {
+		e.WriteByte(propMaxRecv)
+		e.uint16(props.MaxRecv)
+	}
+	if props.MaxPacketSize != 0 {
+		e.WriteByte(propMaxPacketSize)
+		e.uint32(props.MaxPacketSize)
+	}
+	if props.MaxTopicAlias != 0 {
+		e.WriteByte(propMaxTopicAlias)
+		e.uint16(props.MaxTopicAlias)
+	}
+	if props.ReqRespInfo {
+		e.WriteByte(propReqRespInfo)
+		e.WriteByte(1)
+	}
+	if props.ReqProblemInfo {
+		e.WriteByte(propReqProblemInfo)
+		e.WriteByte(1)
+	}
+	if props.AuthMethod != "" {
+		e.WriteByte(propAuthMethod)
+		e.string(props.AuthMethod)
+	}
+	if props.AuthData != nil {
+		e.WriteByte(propAuthData)
+		e.binary(props.AuthData)
+	}
+	e.reason("", props.UserProps)
+	return e
+}
+
+func connAckProps(props *mqtt.ConnAckProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.SessionExpiryInterval != 0 {
+		e.WriteByte(propSessionExpiry)
+		e.uint32(props.SessionExpiryInterval)
+	}
+	if props.MaxRecv != 0 {
+		e.WriteByte(propMaxRecv)
+		e.uint16(props.MaxRecv)
+	}
+	if props.MaxPacketSize != 0 {
+		e.WriteByte(propMaxPacketSize)
+		e.uint32(props.MaxPacketSize)
+	}
+	if props.AssignedClientID != "" {
+		e.WriteByte(propAssignedID)
+		e.string(props.AssignedClientID)
+	}
+	if props.MaxTopicAlias != 0 {
+		e.WriteByte(propMaxTopicAlias)
+		e.uint16(props.MaxTopicAlias)
+	}
+	if props.ServerKeepalive != 0 {
+		e.WriteByte(propServerKeepalive)
+		e.uint16(props.ServerKeepalive)
+	}
+	if props.RespInfo != "" {
+		e.WriteByte(propRespInfo)
+		e.string(props.RespInfo)
+	}
+	if props.ServerRef != "" {
+		e.WriteByte(propServerRef)
+		e.string(props.ServerRef)
+	}
+	if props.AuthMethod != "" {
+		e.WriteByte(propAuthMethod)
+		e.string(props.AuthMethod)
+	}
+	if props.AuthData != nil {
+		e.WriteByte(propAuthData)
+		e.binary(props.AuthData)
+	}
+
+	// server features default to available when absent, only the
+	// unavailable ones are announced
+	if !props.SubIDAvail {
+		e.WriteByte(propSubIDAvail)
+		e.WriteByte(0)
+	}
+	if !props.SharedSubAvail {
+		e.WriteByte(propSharedSubAvail)
+		e.WriteByte(0)
+	}
+	e.reason(props.Reason, props.UserProps)
+	return e
+}
+
+func publishProps(props *mqtt.PublishProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.PayloadFormat != 0 {
+		e.WriteByte(propPayloadFormat)
+		e.WriteByte(props.PayloadFormat)
+	}
+	if props.MessageExpiryInterval != 0 {
+		e.WriteByte(propMessageExpiry)
+		e.uint32(props.MessageExpiryInterval)
+	}
+	if props.TopicAlias != 0 {
+		e.WriteByte(propTopicAlias)
+		e.uint16(props.TopicAlias)
+	}
+	if props.RespTopic != "" {
+		e.WriteByte(propRespTopic)
+		e.string(props.RespTopic)
+	}
+	if props.CorrelationData != nil {
+		e.WriteByte(propCorrelationData)
+		e.binary(props.CorrelationData)
+	}
+	for _, id := range props.SubIDs {
+		e.WriteByte(propSubID)
+		e.varint(id)
+	}
+	if props.ContentType != "" {
+		e.WriteByte(propContentType)
+		e.string(props.ContentType)
+	}
+	e.reason("", props.UserProps)
+	return e
+}
+
+func subscribeProps(props *mqtt.SubscribeProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.SubID != 0 {
+		e.WriteByte(propSubID)
+		e.varint(int(props.SubID))
+	}
+	e.reason("", props.UserProps)
+	return e
+}
+
+// withoutReason returns copy of packet without reason string and user
+// properties, which may be left out when the packet exceeds max packet
+// size of client, nil if the packet has none of them
+func withoutReason(pkt mqtt.Packet) mqtt.Packet {
+	switch p := pkt.(type) {
+	case *mqtt.ConnAckPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.PubAckPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.PubRecvPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.PubRelPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.PubCompPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.SubAckPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *unSubAckPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.DisConnPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	case *mqtt.AuthPacket:
+		if p.Props != nil {
+			q, props := *p, *p.Props
+			if clearReason(&props.Reason, &props.UserProps) {
+				q.Props = &props
+				return &q
+			}
+		}
+	}
+	return nil
+}
+
+// clearReason empties reason string and user properties,
+// return false if both are already empty
+func clearReason(reason *string, userProps *mqtt.UserProperties) bool {
+	if *reason == "" && len(*userProps) == 0 {
+		return false
+	}
+	*reason, *userProps = "", nil
+	return true
+}
+
+// reasonProps encodes reason string and user properties, which are the
+// only properties of acknowledgement packets
+func reasonProps(props interface{}) *propWriter {
+	e := &propWriter{}
+	switch p := props.(type) {
+	case *mqtt.PubAckProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	case *mqtt.PubRecvProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	case *mqtt.PubRelProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	case *mqtt.PubCompProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	case *mqtt.SubAckProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	case *mqtt.UnSubAckProps:
+		if p != nil {
+			e.reason(p.Reason, p.UserProps)
+		}
+	}
+	return e
+}
+
+func disConnProps(props *mqtt.DisConnProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.ServerRef != "" {
+		e.WriteByte(propServerRef)
+		e.string(props.ServerRef)
+	}
+	e.reason(props.Reason, props.UserProps)
+	return e
+}
+
+func authProps(props *mqtt.AuthProps) *propWriter {
+	e := &propWriter{}
+	if props == nil {
+		return e
+	}
+
+	if props.AuthMethod != "" {
+		e.WriteByte(propAuthMethod)
+		e.string(props.AuthMethod)
+	}
+	if props.AuthData != nil {
+		e.WriteByte(propAuthData)
+		e.binary(props.AuthData)
+	}
+	e.reason(props.Reason, props.UserProps)
+	return e
+}
+
+// propWriter writes fields of packet body in order
+type propWriter struct {
+	bytes.Buffer
+}
+
+func (e *propWriter) uint16(v uint16) {
+	e.Write([]byte{byte(v >> 8), byte(v)})
+}
+
+func (e *propWriter) uint32(v uint32) {
+	e.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (e *propWriter) varint(v int) {
+	writeRemainLength(e, v)
+}
+
+// binary writes length prefixed binary data
+func (e *propWriter) binary(v []byte) {
+	e.uint16(uint16(len(v)))
+	e.Write(v)
+}
+
+// string writes length prefixed utf-8 string
+func (e *propWriter) string(v string) {
+	e.uint16(uint16(len(v)))
+	e.WriteString(v)
+}
+
+// reason writes reason string and user properties
+func (e *propWriter) reason(reason string, userProps mqtt.UserProperties) {
+	if reason != "" {
+		e.WriteByte(propReasonString)
+		e.string(reason)
+	}
+
+	for k, values := range userProps {
+		for _, v := range values {
+			e.WriteByte(propUserProps)
+			e.string(k)
+			e.string(v)
+		}
+	}
+}
+
+// props writes properties with its length
+func (e *propWriter) props(props *propWriter) {
+	e.varint(props.Len())
+	e.Write(props.Bytes())
+}
+
+// ack writes packet id and reason code of acknowledgement packets,
+// both reason code and properties are omitted on success
+func (e *propWriter) ack(id uint16, code byte, props *propWriter) {
+	e.uint16(id)
+	if code == mqtt.CodeSuccess && props.Len() == 0 {
+		return
+	}
+
+	e.WriteByte(code)
+	e.props(props)
+}
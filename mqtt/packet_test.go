@@ -0,0 +1,229 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+func readV5(data []byte, maxSize int) (mqtt.Packet, error) {
+	return readPacket(mqtt.V5, bufio.NewReader(bytes.NewReader(data)), maxSize)
+}
+
+func TestDecodeV5(t *testing.T) {
+	publish := &mqtt.PublishPacket{
+		Qos:       mqtt.Qos1,
+		TopicName: "a/b",
+		PacketID:  5,
+		Payload:   []byte("x"),
+		Props:     &mqtt.PublishProps{TopicAlias: 7, UserProps: mqtt.UserProperties{"k": {"v"}}},
+	}
+	publish.ProtoVersion = mqtt.V5
+
+	short := &mqtt.PublishPacket{TopicName: "t", Payload: []byte{}, Props: &mqtt.PublishProps{}}
+	short.ProtoVersion = mqtt.V5
+
+	cases := []struct {
+		name string
+		data []byte
+		want mqtt.Packet
+	}{
+		{"publish", []byte{
+			0x32, 0x13, 0, 3, 'a', '/', 'b', 0, 5,
+			10, 0x23, 0, 7, 0x26, 0, 1, 'k', 0, 1, 'v',
+			'x',
+		}, publish},
+		{"publish without payload", []byte{0x30, 4, 0, 1, 't', 0}, short},
+		{"puback short form", []byte{0x40, 2, 0, 5},
+			&mqtt.PubAckPacket{PacketID: 5, Props: &mqtt.PubAckProps{}}},
+		{"pubrec with reason code", []byte{0x50, 3, 0, 5, 0x10},
+			&mqtt.PubRecvPacket{PacketID: 5, Code: 0x10, Props: &mqtt.PubRecvProps{}}},
+		{"pubrel with reason string", []byte{0x62, 8, 0, 5, 0x92, 4, 0x1f, 0, 1, 'r'},
+			&mqtt.PubRelPacket{PacketID: 5, Code: 0x92, Props: &mqtt.PubRelProps{Reason: "r"}}},
+		{"subscribe with id", []byte{0x82, 9, 0, 1, 2, 0x0b, 3, 0, 1, 't', 1},
+			&subscribePacket{
+				SubscribePacket: mqtt.SubscribePacket{
+					PacketID: 1,
+					Topics:   []*mqtt.Topic{{Name: "t", Qos: mqtt.Qos1}},
+					Props:    &mqtt.SubscribeProps{SubID: 3},
+				},
+				Options: []subOptions{1},
+			}},
+		{"subscribe with options", []byte{0x82, 7, 0, 1, 0, 0, 1, 't', 0x2e},
+			&subscribePacket{
+				SubscribePacket: mqtt.SubscribePacket{
+					PacketID: 1,
+					Topics:   []*mqtt.Topic{{Name: "t", Qos: mqtt.Qos2}},
+					Props:    &mqtt.SubscribeProps{},
+				},
+				Options: []subOptions{subNoLocal | subRetainAsPublished | retainNever<<4 | 2},
+			}},
+		{"unsubscribe", []byte{0xa2, 9, 0, 2, 0, 0, 1, 'a', 0, 1, 'b'},
+			&mqtt.UnSubPacket{PacketID: 2, TopicNames: []string{"a", "b"}, Props: &mqtt.UnSubProps{}}},
+		{"disconnect short form", []byte{0xe0, 0}, &mqtt.DisConnPacket{Props: &mqtt.DisConnProps{}}},
+		{"disconnect with expiry", []byte{0xe0, 7, 0x04, 5, 0x11, 0, 0, 0, 9},
+			&mqtt.DisConnPacket{Code: 0x04, Props: &mqtt.DisConnProps{SessionExpiryInterval: 9}}},
+		{"pingreq", []byte{0xc0, 0}, mqtt.PingReqPacket},
+
+		// malformed packets
+		{"bad fixed header flags", []byte{0x80, 6, 0, 1, 0, 0, 1, 't'}, nil},
+		{"reserved subscription options", []byte{0x82, 7, 0, 1, 0, 0, 1, 't', 0xc1}, nil},
+		{"bad retain handling", []byte{0x82, 7, 0, 1, 0, 0, 1, 't', 0x31}, nil},
+		{"unknown property", []byte{0x40, 6, 0, 5, 0x10, 2, 0x01, 1}, nil},
+		{"trailing bytes", []byte{0xc0, 1, 0}, nil},
+		{"truncated body", []byte{0x40, 3, 0, 5}, nil},
+		{"packet only sent by server", []byte{0x20, 2, 0, 0}, nil},
+	}
+
+	for _, c := range cases {
+		got, err := readV5(c.data, 0)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want error", c.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", c.name, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEncodeV5(t *testing.T) {
+	cases := []struct {
+		name string
+		pkt  mqtt.Packet
+		want []byte
+	}{
+		{"connack", &mqtt.ConnAckPacket{Present: true, Props: &mqtt.ConnAckProps{
+			MaxRecv: 10, SubIDAvail: true, SharedSubAvail: true,
+		}}, []byte{0x20, 6, 1, 0, 3, 0x21, 0, 10}},
+		{"connack announces unavailable features", &mqtt.ConnAckPacket{Code: 0x87, Props: &mqtt.ConnAckProps{}},
+			[]byte{0x20, 7, 0, 0x87, 4, 0x29, 0, 0x2a, 0}},
+		{"puback short form", &mqtt.PubAckPacket{PacketID: 5}, []byte{0x40, 2, 0, 5}},
+		{"puback with reason code", &mqtt.PubAckPacket{PacketID: 5, Code: 0x10},
+			[]byte{0x40, 4, 0, 5, 0x10, 0}},
+		{"pubrel", &mqtt.PubRelPacket{PacketID: 5}, []byte{0x62, 2, 0, 5}},
+		{"suback", &mqtt.SubAckPacket{PacketID: 1, Codes: []byte{1, 0x87}},
+			[]byte{0x90, 5, 0, 1, 0, 1, 0x87}},
+		{"unsuback", &unSubAckPacket{UnSubAckPacket: mqtt.UnSubAckPacket{PacketID: 1}, Codes: []byte{0x11}},
+			[]byte{0xb0, 4, 0, 1, 0, 0x11}},
+		{"publish", &mqtt.PublishPacket{
+			Qos: mqtt.Qos2, IsDup: true, IsRetain: true, TopicName: "t", PacketID: 3, Payload: []byte("x"),
+			Props: &mqtt.PublishProps{MessageExpiryInterval: 1},
+		}, []byte{0x3d, 12, 0, 1, 't', 0, 3, 5, 0x02, 0, 0, 0, 1, 'x'}},
+		{"disconnect", &mqtt.DisConnPacket{Code: 0x8e, Props: &mqtt.DisConnProps{Reason: "r"}},
+			[]byte{0xe0, 6, 0x8e, 4, 0x1f, 0, 1, 'r'}},
+		{"pingresp", mqtt.PingRespPacket, []byte{0xd0, 0}},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		w := bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))
+		if err := writePacket(w, mqtt.V5, c.pkt, 0); err != nil {
+			t.Errorf("%s: encode failed: %v", c.name, err)
+		} else if !bytes.Equal(buf.Bytes(), c.want) {
+			t.Errorf("%s: got % x, want % x", c.name, buf.Bytes(), c.want)
+		}
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	data := []byte{0x30, 4, 0, 1, 't', 0}
+	if _, err := readV5(data, len(data)-1); err != errPacketTooLarge {
+		t.Errorf("read: got %v, want %v", err, errPacketTooLarge)
+	}
+	if _, err := readV5(data, len(data)); err != nil {
+		t.Errorf("read at limit: got %v, want nil", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w := bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))
+	pkt := &mqtt.PublishPacket{TopicName: "t"}
+	if err := writePacket(w, mqtt.V5, pkt, len(data)-1); err != errPacketTooLarge || buf.Len() != 0 {
+		t.Errorf("write: got (%v, % x), want %v and nothing written", err, buf.Bytes(), errPacketTooLarge)
+	}
+	if err := writePacket(w, mqtt.V5, pkt, len(data)); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("write at limit: got (%v, % x), want % x", err, buf.Bytes(), data)
+	}
+
+	if got := packetSize(127); got != 129 {
+		t.Errorf("packetSize(127) = %d, want 129", got)
+	}
+	if got := packetSize(128); got != 131 {
+		t.Errorf("packetSize(128) = %d, want 131", got)
+	}
+}
+
+func TestWithoutReason(t *testing.T) {
+	userProps := mqtt.UserProperties{"k": {"v"}}
+	cases := []struct {
+		name string
+		pkt  mqtt.Packet
+		want []byte // encoded without reason, nil if nothing left out
+	}{
+		{"puback", &mqtt.PubAckPacket{PacketID: 1, Code: mqtt.CodeNotAuthorized, Props: &mqtt.PubAckProps{Reason: "no"}},
+			[]byte{0x40, 4, 0, 1, 0x87, 0}},
+		{"pubrel", &mqtt.PubRelPacket{PacketID: 1, Props: &mqtt.PubRelProps{UserProps: userProps}},
+			[]byte{0x62, 2, 0, 1}},
+		{"suback", &mqtt.SubAckPacket{PacketID: 1, Codes: []byte{0}, Props: &mqtt.SubAckProps{Reason: "ok", UserProps: userProps}},
+			[]byte{0x90, 4, 0, 1, 0, 0}},
+		{"unsuback", &unSubAckPacket{UnSubAckPacket: mqtt.UnSubAckPacket{PacketID: 1, Props: &mqtt.UnSubAckProps{Reason: "ok"}}, Codes: []byte{0}},
+			[]byte{0xb0, 4, 0, 1, 0, 0}},
+		{"disconnect", &mqtt.DisConnPacket{Code: mqtt.CodeProtoError, Props: &mqtt.DisConnProps{Reason: "bad", ServerRef: "s"}},
+			[]byte{0xe0, 6, 0x82, 4, 0x1c, 0, 1, 's'}},
+		{"publish", &mqtt.PublishPacket{TopicName: "t", Props: &mqtt.PublishProps{UserProps: userProps}}, nil},
+		{"no props", &mqtt.PubAckPacket{PacketID: 1}, nil},
+		{"nothing to leave out", &mqtt.DisConnPacket{Props: &mqtt.DisConnProps{ServerRef: "s"}}, nil},
+	}
+
+	for _, c := range cases {
+		before, _, _ := encodeV5(c.pkt)
+		_, body, _ := encodeV5(c.pkt)
+
+		got := withoutReason(c.pkt)
+		if c.want == nil {
+			if got != nil {
+				t.Errorf("%s: got %+v, want nil", c.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: got nil, want % x", c.name, c.want)
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		w := bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))
+		if err := writePacket(w, mqtt.V5, got, len(c.want)); err != nil || !bytes.Equal(buf.Bytes(), c.want) {
+			t.Errorf("%s: got (%v, % x), want % x", c.name, err, buf.Bytes(), c.want)
+		}
+
+		// packet may be shared, only the copy is changed
+		if after, bodyAfter, _ := encodeV5(c.pkt); after != before || !bytes.Equal(bodyAfter, body) {
+			t.Errorf("%s: original packet changed", c.name)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// persistMethods creates persist method by name, methods backed by
+// external storage are registered by persist_ext.go when built with
+// "extension" tag
+var persistMethods = map[string]func(cfg *Options) (mqtt.PersistMethod, error){
+	"none": func(cfg *Options) (mqtt.PersistMethod, error) {
+		return mqtt.NonePersist, nil
+	},
+	"mem": func(cfg *Options) (mqtt.PersistMethod, error) {
+		return newKVPersist("mem", &memKV{data: make(map[string][]byte)}, cfg, 0)
+	},
+	"file": func(cfg *Options) (mqtt.PersistMethod, error) {
+		if cfg.FilePersistDir == "" {
+			return nil, fmt.Errorf("file persist requires %s", cfgFilePersistDir)
+		}
+
+		if err := os.MkdirAll(cfg.FilePersistDir, 0700); err != nil {
+			return nil, err
+		}
+
+		return newKVPersist("file", &fileKV{dir: cfg.FilePersistDir}, cfg, cfg.FilePersistInterval)
+	},
+}
+
+// initPersist creates the configured persist method
+func initPersist(cfg *Options) (mqtt.PersistMethod, error) {
+	create, ok := persistMethods[cfg.PersistMethod]
+	if !ok {
+		return nil, fmt.Errorf("persist method %q not supported or not built in", cfg.PersistMethod)
+	}
+
+	return create(cfg)
+}
+
+// closePersist writes changes buffered by persist method and releases
+// its storage
+func (s *Server) closePersist() {
+	p, ok := s.persist.(*kvPersist)
+	if !ok {
+		return
+	}
+
+	p.flush()
+	if err := p.kv.close(); err != nil {
+		s.log.Warn("close persist storage failed", zap.String("persist", p.name), zap.Error(err))
+	}
+}
+
+// encodePersist encodes packet in the format of mqtt 5, libmqtt persist
+// methods encode packets of mqtt 3.1.1, which loses properties and can't
+// decode publish packet with payload shorter than 2 bytes
+func encodePersist(pkt mqtt.Packet) ([]byte, error) {
+	header, body, err := encodeV5(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(header)
+	writeRemainLength(buf, len(body))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func decodePersist(data []byte) (mqtt.Packet, error) {
+	return readPacket(mqtt.V5, bufio.NewReader(bytes.NewReader(data)), 0)
+}
+
+// kvStore is the storage of persist method, values are encoded packets
+type kvStore interface {
+	// get value of key, nil if not exists
+	get(key string) ([]byte, error)
+	// put value with key, existing value is replaced
+	put(key string, value []byte) error
+	// del removes key, missing key is not an error
+	del(key string) error
+	// each calls f for all keys until it returns false
+	each(f func(key string, value []byte) bool) error
+	close() error
+}
+
+// kvPersist is the persist method of imq, packets are encoded with
+// encodePersist and stored in kvStore, existing packet is always
+// replaced, changes are kept in memory and written every interval
+// when interval is positive
+type kvPersist struct {
+	name         string
+	kv           kvStore
+	log          *zap.Logger
+	maxCount     int
+	dropOnExceed bool
+	interval     time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]struct{} // keys stored, including pending ones
+	pending map[string][]byte   // changes not written, nil for deleted
+	timer   *time.Timer         // timer to write pending changes
+	flushMu sync.Mutex          // serializes writing of pending changes
+}
+
+// newKVPersist creates persist method with the storage, which is closed
+// if the persist method can't be created
+func newKVPersist(name string, kv kvStore, cfg *Options, interval time.Duration) (*kvPersist, error) {
+	p := &kvPersist{
+		name:         name,
+		kv:           kv,
+		log:          cfg.Logger,
+		maxCount:     cfg.PersistMaxCount,
+		dropOnExceed: cfg.PersistDropOnExceed,
+		interval:     interval,
+		keys:         make(map[string]struct{}),
+		pending:      make(map[string][]byte),
+	}
+
+	if err := kv.each(func(key string, value []byte) bool {
+		p.keys[key] = struct{}{}
+		return true
+	}); err != nil {
+		kv.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *kvPersist) Name() string {
+	return p.name
+}
+
+func (p *kvPersist) Store(key string, pkt mqtt.Packet) error {
+	data, err := encodePersist(pkt)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.keys[key]; !ok && p.dropOnExceed && p.maxCount > 0 && len(p.keys) >= p.maxCount {
+		return mqtt.ErrPacketDroppedByStrategy
+	}
+	p.keys[key] = struct{}{}
+	return p.change(key, data)
+}
+
+func (p *kvPersist) Load(key string) (mqtt.Packet, bool) {
+	p.mu.Lock()
+	data, ok := p.pending[key]
+	p.mu.Unlock()
+
+	if !ok {
+		var err error
+		if data, err = p.kv.get(key); err != nil {
+			p.log.Warn("read persisted state failed", zap.String("key", key), zap.Error(err))
+			return nil, false
+		}
+	}
+
+	if data == nil {
+		return nil, false
+	}
+	return p.decode(key, data)
+}
+
+func (p *kvPersist) Range(ranger func(key string, pkt mqtt.Packet) bool) {
+	p.mu.Lock()
+	pending := make(map[string][]byte, len(p.pending))
+	for key, data := range p.pending {
+		pending[key] = data
+	}
+	p.mu.Unlock()
+
+	done := false
+	err := p.kv.each(func(key string, data []byte) bool {
+		if _, ok := pending[key]; ok {
+			return true
+		}
+
+		if pkt, ok := p.decode(key, data); ok && !ranger(key, pkt) {
+			done = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		p.log.Warn("read persisted state failed", zap.String("persist", p.name), zap.Error(err))
+	}
+
+	if done {
+		return
+	}
+
+	for key, data := range pending {
+		if data == nil {
+			continue
+		}
+
+		if pkt, ok := p.decode(key, data); ok && !ranger(key, pkt) {
+			return
+		}
+	}
+}
+
+func (p *kvPersist) Delete(key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.keys, key)
+	return p.change(key, nil)
+}
+
+// Destroy removes all stored packets
+func (p *kvPersist) Destroy() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key := range p.keys {
+		if err := p.change(key, nil); err != nil {
+			return err
+		}
+		delete(p.keys, key)
+	}
+	return nil
+}
+
+// change writes value of key or deletes it when value is nil,
+// it is buffered when interval is positive
+func (p *kvPersist) change(key string, data []byte) error {
+	if p.interval > 0 {
+		p.pending[key] = data
+		if p.timer == nil {
+			p.timer = time.AfterFunc(p.interval, p.flush)
+		}
+		return nil
+	}
+
+	if data == nil {
+		return p.kv.del(key)
+	}
+	return p.kv.put(key, data)
+}
+
+func (p *kvPersist) decode(key string, data []byte) (mqtt.Packet, bool) {
+	pkt, err := decodePersist(data)
+	if err != nil {
+		p.log.Warn("decode persisted state failed", zap.String("key", key), zap.Error(err))
+		return nil, false
+	}
+	return pkt, true
+}
+
+// flush writes pending changes to storage
+func (p *kvPersist) flush() {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[string][]byte)
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+
+	for key, data := range pending {
+		var err error
+		if data == nil {
+			err = p.kv.del(key)
+		} else {
+			err = p.kv.put(key, data)
+		}
+
+		if err != nil {
+			p.log.Warn("write persisted state failed", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// memKV keeps values in memory
+type memKV struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func (m *memKV) get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data[key], nil
+}
+
+func (m *memKV) put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = value
+	return nil
+}
+
+func (m *memKV) del(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memKV) each(f func(key string, value []byte) bool) error {
+	m.mu.RLock()
+	data := make(map[string][]byte, len(m.data))
+	for key, value := range m.data {
+		data[key] = value
+	}
+	m.mu.RUnlock()
+
+	for key, value := range data {
+		if !f(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memKV) close() error {
+	return nil
+}
+
+const filePersistSuffix = ".mqtt"
+
+// keys longer than this are stored in files named by sha256 of the key,
+// which keeps file names within the limit of file systems
+const fileKeyMax = 200
+
+// fileKV keeps values in files of the directory, one file per key,
+// file is replaced by rename so that a crash never leaves it partial,
+// the key is kept in the first line of the file since long keys are
+// not recoverable from the file name
+type fileKV struct {
+	dir string
+}
+
+func (f *fileKV) path(key string) string {
+	name := key
+	if len(name) > fileKeyMax {
+		sum := sha256.Sum256([]byte(key))
+		name = hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(f.dir, name+filePersistSuffix)
+}
+
+// read returns the key and value stored in file, value is nil if the file
+// does not exist or is not a valid record
+func (f *fileKV) read(path string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", nil, nil
+	}
+	return string(data[:i]), data[i+1:], nil
+}
+
+func (f *fileKV) get(key string) ([]byte, error) {
+	stored, data, err := f.read(f.path(key))
+	if err != nil || stored != key {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (f *fileKV) put(key string, value []byte) error {
+	path := f.path(key)
+	tmp, err := ioutil.TempFile(f.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(key + "\n")
+	if err == nil {
+		_, err = tmp.Write(value)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *fileKV) del(key string) error {
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileKV) each(fn func(key string, value []byte) bool) error {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), filePersistSuffix) {
+			continue
+		}
+
+		key, data, err := f.read(filepath.Join(f.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		if data != nil && !fn(key, data) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fileKV) close() error {
+	return nil
+}
+
+// kinds of persisted state, persist key is formed as kind.name[.id],
+// name is the client id or topic name encoded to be safe as file name
+const (
+	keySession  = "s"   // session marker, connect packet
+	keySubs     = "sub" // subscriptions, subscribe packet
+	keyOutbound = "out" // inflight outbound message, publish or pubrel packet
+	keyQueued   = "q"   // queued outbound message, publish packet
+	keyInbound  = "in"  // inbound qos 2 message waiting pubrel, pubrec packet
+	keyRetain   = "r"   // retained message, publish packet
+)
+
+const keySep = "."
+
+var keyEncoding = base64.RawURLEncoding
+
+func persistKey(kind, name string, id ...uint64) string {
+	key := kind + keySep + keyEncoding.EncodeToString([]byte(name))
+	if len(id) > 0 {
+		key += keySep + strconv.FormatUint(id[0], 10)
+	}
+	return key
+}
+
+func parsePersistKey(key string) (kind, name string, id uint64, ok bool) {
+	parts := strings.Split(key, keySep)
+	if len(parts) < 2 || len(parts) > 3 {
+		return
+	}
+
+	rawName, err := keyEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+
+	if len(parts) == 3 {
+		if id, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+			return
+		}
+	}
+
+	return parts[0], string(rawName), id, true
+}
+
+// store packet with key, existing packet is replaced
+func (s *Server) persistStore(key string, pkt mqtt.Packet) {
+	if err := s.persist.Store(key, pkt); err != nil {
+		s.log.Warn("persist session state failed", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (s *Server) persistDelete(key string) {
+	if err := s.persist.Delete(key); err != nil {
+		s.log.Warn("delete session state failed", zap.String("key", key), zap.Error(err))
+	}
+}
@@ -0,0 +1,298 @@
+//go:build extension
+// +build extension
+
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-redis/redis"
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+const (
+	persistMainKey     = "imq"
+	persistDialTimeout = 5 * time.Second
+)
+
+// persist methods backed by external storage, build with "-tags extension"
+// to enable them
+func init() {
+	persistMethods["redis"] = func(cfg *Options) (mqtt.PersistMethod, error) {
+		client := redis.NewClient(&redis.Options{
+			Addr:        cfg.RedisAddr,
+			Password:    cfg.RedisAuth,
+			DB:          cfg.RedisDB,
+			DialTimeout: persistDialTimeout,
+		})
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		return newKVPersist("redis", &redisKV{client: client}, cfg, 0)
+	}
+
+	persistMethods["etcd"] = func(cfg *Options) (mqtt.PersistMethod, error) {
+		if cfg.EtcdAddr == "" {
+			return nil, fmt.Errorf("etcd persist requires %s", cfgEtcdAddr)
+		}
+
+		return newKVPersist("etcd", &etcdKV{
+			endpoints: strings.Split(cfg.EtcdAddr, ","),
+			client:    &http.Client{Timeout: persistDialTimeout},
+		}, cfg, 0)
+	}
+
+	persistMethods["boltdb"] = func(cfg *Options) (mqtt.PersistMethod, error) {
+		if cfg.BoltPersistFile == "" {
+			return nil, fmt.Errorf("boltdb persist requires %s", cfgBoltPersistFile)
+		}
+
+		db, err := bolt.Open(cfg.BoltPersistFile, 0600, &bolt.Options{Timeout: persistDialTimeout})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(persistMainKey))
+			return err
+		}); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		return newKVPersist("boltdb", &boltKV{db: db}, cfg, 0)
+	}
+}
+
+// redisKV keeps values in the hash of persistMainKey
+type redisKV struct {
+	client *redis.Client
+}
+
+func (r *redisKV) get(key string) ([]byte, error) {
+	value, err := r.client.HGet(persistMainKey, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (r *redisKV) put(key string, value []byte) error {
+	return r.client.HSet(persistMainKey, key, value).Err()
+}
+
+func (r *redisKV) del(key string) error {
+	return r.client.HDel(persistMainKey, key).Err()
+}
+
+func (r *redisKV) each(f func(key string, value []byte) bool) error {
+	values, err := r.client.HGetAll(persistMainKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		if !f(key, []byte(value)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (r *redisKV) close() error {
+	return r.client.Close()
+}
+
+// errStopEach stops iteration of bolt bucket
+var errStopEach = errors.New("stop iteration")
+
+// boltKV keeps values in the bucket of persistMainKey
+type boltKV struct {
+	db *bolt.DB
+}
+
+func (b *boltKV) get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// values are only valid in transaction
+		if v := tx.Bucket([]byte(persistMainKey)).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltKV) put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistMainKey)).Put([]byte(key), value)
+	})
+}
+
+func (b *boltKV) del(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistMainKey)).Delete([]byte(key))
+	})
+}
+
+func (b *boltKV) each(f func(key string, value []byte) bool) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistMainKey)).ForEach(func(k, v []byte) error {
+			if !f(string(k), append([]byte{}, v...)) {
+				return errStopEach
+			}
+			return nil
+		})
+	})
+	if err == errStopEach {
+		return nil
+	}
+	return err
+}
+
+func (b *boltKV) close() error {
+	return b.db.Close()
+}
+
+// etcdKV keeps values under the prefix of persistMainKey, it calls the
+// json gateway of etcd v3 api (etcd 3.4 or later), which needs no grpc
+// client
+type etcdKV struct {
+	endpoints []string
+	client    *http.Client
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+func (e *etcdKV) key(key string) []byte {
+	return []byte(persistMainKey + "/" + key)
+}
+
+func (e *etcdKV) get(key string) ([]byte, error) {
+	resp := &etcdRangeResponse{}
+	if err := e.call("/v3/kv/range", &etcdRangeRequest{Key: e.key(key)}, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (e *etcdKV) put(key string, value []byte) error {
+	return e.call("/v3/kv/put", &etcdKeyValue{Key: e.key(key), Value: value}, nil)
+}
+
+func (e *etcdKV) del(key string) error {
+	return e.call("/v3/kv/deleterange", &etcdRangeRequest{Key: e.key(key)}, nil)
+}
+
+func (e *etcdKV) each(f func(key string, value []byte) bool) error {
+	// range end of prefix "imq/" is "imq0"
+	req := &etcdRangeRequest{Key: e.key(""), RangeEnd: []byte(persistMainKey + "0")}
+	resp := &etcdRangeResponse{}
+	if err := e.call("/v3/kv/range", req, resp); err != nil {
+		return err
+	}
+
+	prefix := string(e.key(""))
+	for _, kv := range resp.Kvs {
+		if !f(strings.TrimPrefix(string(kv.Key), prefix), kv.Value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *etcdKV) close() error {
+	return nil
+}
+
+// call the api with the first endpoint answering it
+func (e *etcdKV) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range e.endpoints {
+		if err = e.post(strings.TrimSpace(endpoint)+path, body, resp); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (e *etcdKV) post(url string, body []byte, resp interface{}) error {
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistDialTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(r.Body, 512))
+		return fmt.Errorf("etcd answered with status %d: %s", r.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	if resp == nil {
+		// drain body to reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
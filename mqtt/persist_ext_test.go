@@ -0,0 +1,46 @@
+//go:build extension
+// +build extension
+
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBoltPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imq-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Options{Logger: zap.NewNop(), BoltPersistFile: filepath.Join(dir, "imq.db")}
+	p, err := persistMethods["boltdb"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.(*kvPersist).kv.close()
+
+	testKVPersist(t, p.(*kvPersist))
+}
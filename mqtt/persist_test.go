@@ -0,0 +1,246 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+func persistPackets() map[string]mqtt.Packet {
+	pkts := map[string]mqtt.Packet{
+		persistKey(keySession, "c1"): &mqtt.ConnPacket{
+			ProtoName: protoName,
+			ClientID:  "c1",
+			Props: &mqtt.ConnProps{
+				SessionExpiryInterval: 3600,
+				UserProps:             mqtt.UserProperties{"k": {"v"}},
+			},
+		},
+		persistKey(keySubs, "c1"): &subscribePacket{
+			SubscribePacket: mqtt.SubscribePacket{
+				Topics: []*mqtt.Topic{{Name: "a/+", Qos: mqtt.Qos1}, {Name: "b/#", Qos: mqtt.Qos2}},
+				Props:  &mqtt.SubscribeProps{},
+			},
+			Options: []subOptions{1, subNoLocal | 2},
+		},
+		// qos 0 message with payload shorter than 2 bytes
+		persistKey(keyRetain, "short"): &mqtt.PublishPacket{
+			IsRetain:  true,
+			TopicName: "short",
+			Payload:   []byte{1},
+			Props:     &mqtt.PublishProps{},
+		},
+		persistKey(keyRetain, "props"): &mqtt.PublishPacket{
+			Qos:       mqtt.Qos1,
+			IsRetain:  true,
+			TopicName: "props",
+			Payload:   []byte("payload"),
+			Props: &mqtt.PublishProps{
+				PayloadFormat:         1,
+				MessageExpiryInterval: 60,
+				ContentType:           "text/plain",
+				RespTopic:             "resp",
+				CorrelationData:       []byte("corr"),
+				UserProps:             mqtt.UserProperties{"k": {"v1", "v2"}},
+			},
+		},
+		persistKey(keyOutbound, "c1", 7): &mqtt.PubRelPacket{PacketID: 7, Props: &mqtt.PubRelProps{}},
+		persistKey(keyInbound, "c1", 8):  &mqtt.PubRecvPacket{PacketID: 8, Props: &mqtt.PubRecvProps{}},
+	}
+	// decoded packets carry version of the format
+	for _, pkt := range pkts {
+		switch p := pkt.(type) {
+		case *mqtt.ConnPacket:
+			p.ProtoVersion = mqtt.V5
+		case *mqtt.PublishPacket:
+			p.ProtoVersion = mqtt.V5
+		}
+	}
+	return pkts
+}
+
+func TestPersistCodec(t *testing.T) {
+	for key, pkt := range persistPackets() {
+		data, err := encodePersist(pkt)
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", key, err)
+			continue
+		}
+
+		got, err := decodePersist(data)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", key, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, pkt) {
+			t.Errorf("%s: got %+v, want %+v", key, got, pkt)
+		}
+	}
+}
+
+func testKVPersist(t *testing.T, p *kvPersist) {
+	pkts := persistPackets()
+	for key, pkt := range pkts {
+		if err := p.Store(key, pkt); err != nil {
+			t.Fatalf("store %s failed: %v", key, err)
+		}
+	}
+
+	// stored packet is replaced
+	retain := persistKey(keyRetain, "short")
+	pkts[retain] = pkts[persistKey(keyRetain, "props")]
+	if err := p.Store(retain, pkts[retain]); err != nil {
+		t.Fatalf("replace %s failed: %v", retain, err)
+	}
+
+	deleted := persistKey(keyInbound, "c1", 8)
+	delete(pkts, deleted)
+	if err := p.Delete(deleted); err != nil {
+		t.Fatalf("delete %s failed: %v", deleted, err)
+	}
+
+	check := func(stage string) {
+		got := make(map[string]mqtt.Packet)
+		p.Range(func(key string, pkt mqtt.Packet) bool {
+			got[key] = pkt
+			return true
+		})
+		if !reflect.DeepEqual(got, pkts) {
+			t.Errorf("%s: range got %+v, want %+v", stage, got, pkts)
+		}
+
+		if pkt, ok := p.Load(retain); !ok || !reflect.DeepEqual(pkt, pkts[retain]) {
+			t.Errorf("%s: load %s got (%+v, %v)", stage, retain, pkt, ok)
+		}
+		if _, ok := p.Load(deleted); ok {
+			t.Errorf("%s: deleted %s loaded", stage, deleted)
+		}
+	}
+
+	check("before flush")
+	p.flush()
+	check("after flush")
+}
+
+func TestMemPersist(t *testing.T) {
+	p, err := persistMethods["mem"](&Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKVPersist(t, p.(*kvPersist))
+}
+
+func TestFilePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imq-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Options{Logger: zap.NewNop(), FilePersistDir: dir, FilePersistInterval: time.Hour}
+	p, err := persistMethods["file"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKVPersist(t, p.(*kvPersist))
+
+	// packets written are loaded after restart
+	p, err = persistMethods["file"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	p.Range(func(key string, pkt mqtt.Packet) bool {
+		count++
+		return true
+	})
+	if want := len(persistPackets()) - 1; count != want {
+		t.Errorf("restart: got %d packets, want %d", count, want)
+	}
+}
+
+func TestFilePersistLongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imq-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Options{Logger: zap.NewNop(), FilePersistDir: dir, FilePersistInterval: time.Hour}
+	p, err := persistMethods["file"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := strings.Repeat("a/", 150)
+	key := persistKey(keyRetain, topic)
+	if err := p.Store(key, &mqtt.PublishPacket{TopicName: topic, Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	p.(*kvPersist).flush()
+
+	p, err = persistMethods["file"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []string
+	p.Range(func(key string, pkt mqtt.Packet) bool {
+		loaded = append(loaded, key)
+		return true
+	})
+	if len(loaded) != 1 || loaded[0] != key {
+		t.Fatalf("restart: got keys %q, want %q", loaded, key)
+	}
+	if _, name, _, ok := parsePersistKey(loaded[0]); !ok || name != topic {
+		t.Errorf("restart: got name %q, want %q", name, topic)
+	}
+}
+
+func TestPersistMaxCount(t *testing.T) {
+	cfg := &Options{Logger: zap.NewNop(), PersistMaxCount: 1, PersistDropOnExceed: true}
+	p, err := persistMethods["mem"](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := &mqtt.PubRelPacket{PacketID: 1}
+	if err := p.Store("a", pkt); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Store("a", pkt); err != nil {
+		t.Errorf("replace: got %v, want nil", err)
+	}
+	if err := p.Store("b", pkt); err != mqtt.ErrPacketDroppedByStrategy {
+		t.Errorf("exceed: got %v, want %v", err, mqtt.ErrPacketDroppedByStrategy)
+	}
+
+	p.Delete("a")
+	if err := p.Store("b", pkt); err != nil {
+		t.Errorf("after delete: got %v, want nil", err)
+	}
+}
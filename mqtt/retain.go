@@ -0,0 +1,180 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// retainTree stores the last retained message of each topic name,
+// topic names are split into levels and stored as a trie so that
+// topic filters with wildcards can be matched against it
+type retainTree struct {
+	srv  *Server
+	mu   sync.RWMutex
+	root *retainNode
+}
+
+type retainNode struct {
+	children map[string]*retainNode
+	msg      *mqtt.PublishPacket
+}
+
+func newRetainTree(srv *Server) *retainTree {
+	return &retainTree{srv: srv, root: newRetainNode()}
+}
+
+func newRetainNode() *retainNode {
+	return &retainNode{children: make(map[string]*retainNode)}
+}
+
+// load retained messages saved by persist method
+func (t *retainTree) load() {
+	count := 0
+	t.srv.persist.Range(func(key string, pkt mqtt.Packet) bool {
+		kind, _, _, ok := parsePersistKey(key)
+		if !ok || kind != keyRetain {
+			return true
+		}
+
+		if p, ok := pkt.(*mqtt.PublishPacket); ok {
+			t.put(p)
+			count++
+		}
+		return true
+	})
+	t.srv.log.Info("persisted retained messages loaded", zap.Int("count", count))
+}
+
+// set retained message of the topic, message with empty payload
+// removes the retained message
+func (t *retainTree) set(pkt *mqtt.PublishPacket) {
+	key := persistKey(keyRetain, pkt.TopicName)
+	if len(pkt.Payload) == 0 {
+		t.remove(pkt.TopicName)
+		t.srv.persistDelete(key)
+		return
+	}
+
+	msg := &mqtt.PublishPacket{
+		Qos:       pkt.Qos,
+		IsRetain:  true,
+		TopicName: pkt.TopicName,
+		Payload:   pkt.Payload,
+		Props:     pkt.Props,
+	}
+	t.put(msg)
+	t.srv.persistStore(key, msg)
+}
+
+func (t *retainTree) put(msg *mqtt.PublishPacket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for _, level := range strings.Split(msg.TopicName, topicSep) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newRetainNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.msg = msg
+}
+
+func (t *retainTree) remove(topic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.root.remove(strings.Split(topic, topicSep))
+}
+
+func (n *retainNode) remove(levels []string) {
+	if len(levels) == 0 {
+		n.msg = nil
+		return
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+
+	child.remove(levels[1:])
+	if child.msg == nil && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match retained messages of all topic names matching the topic filter
+func (t *retainTree) match(filter string) []*mqtt.PublishPacket {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var result []*mqtt.PublishPacket
+	t.root.match(strings.Split(filter, topicSep), true, &result)
+	return result
+}
+
+func (n *retainNode) match(levels []string, root bool, result *[]*mqtt.PublishPacket) {
+	if len(levels) == 0 {
+		if n.msg != nil {
+			*result = append(*result, n.msg)
+		}
+		return
+	}
+
+	switch levels[0] {
+	case wildcardMulti:
+		// "#" matches the parent level as well as any number of child levels
+		if n.msg != nil {
+			*result = append(*result, n.msg)
+		}
+		for name, child := range n.children {
+			if root && strings.HasPrefix(name, sysTopicPrefix) {
+				continue
+			}
+			child.collect(result)
+		}
+	case wildcardSingle:
+		for name, child := range n.children {
+			if root && strings.HasPrefix(name, sysTopicPrefix) {
+				continue
+			}
+			child.match(levels[1:], false, result)
+		}
+	default:
+		if child, ok := n.children[levels[0]]; ok {
+			child.match(levels[1:], false, result)
+		}
+	}
+}
+
+func (n *retainNode) collect(result *[]*mqtt.PublishPacket) {
+	if n.msg != nil {
+		*result = append(*result, n.msg)
+	}
+
+	for _, child := range n.children {
+		child.collect(result)
+	}
+}
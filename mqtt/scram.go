@@ -0,0 +1,259 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// AuthMethodSCRAMSHA256 is the enhanced authentication method of
+// SCRAM-SHA-256 (RFC 7677) without channel binding
+const AuthMethodSCRAMSHA256 = "SCRAM-SHA-256"
+
+// length of server part of the nonce
+const scramNonceLen = 18
+
+var errBadSCRAMMessage = errors.New("malformed scram message")
+
+// scramFakeKey derives credentials of unknown users, which must not change
+// between exchanges or the users are told apart from known ones
+var scramFakeKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// SCRAMCredentials are the keys derived from salted password, which are
+// verified against client proof without knowing the password
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMStore looks up SCRAM-SHA-256 credentials of users, ErrBadCredentials
+// is returned if the user is unknown or has no credentials
+type SCRAMStore interface {
+	LookupSCRAM(username string) (*SCRAMCredentials, error)
+}
+
+// newSCRAMCredentials derives credentials from the salted password
+func newSCRAMCredentials(salt []byte, iter int, saltedPassword []byte) *SCRAMCredentials {
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iter,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+// SCRAMSHA256 is the AuthMethod of SCRAM-SHA-256, client first message
+// is the auth data of connect packet or auth packet of re-authentication,
+// server final message is sent in connack or auth packet of success
+type SCRAMSHA256 struct {
+	Store SCRAMStore
+}
+
+// NewExchange implements AuthMethod
+func (m *SCRAMSHA256) NewExchange(info *AuthInfo) AuthExchange {
+	return &scramExchange{store: m.Store, info: info}
+}
+
+type scramExchange struct {
+	store SCRAMStore
+	info  *AuthInfo
+	step  int
+
+	creds       *SCRAMCredentials
+	nonce       string
+	clientFirst string // client first message without gs2 header
+	serverFirst string
+}
+
+// Next implements AuthExchange
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		resp, err := e.first(string(data))
+		return resp, false, err
+	case 2:
+		resp, err := e.final(string(data))
+		return resp, err == nil, err
+	default:
+		return nil, false, errBadSCRAMMessage
+	}
+}
+
+// first handles "n,,n=<user>,r=<client nonce>" and answers with
+// "r=<client nonce><server nonce>,s=<salt>,i=<iterations>"
+func (e *scramExchange) first(msg string) ([]byte, error) {
+	// gs2 header, channel binding is not supported
+	if !strings.HasPrefix(msg, "n,") && !strings.HasPrefix(msg, "y,") {
+		return nil, errBadSCRAMMessage
+	}
+
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || parts[1] != "" {
+		// authorization identity is not supported
+		return nil, errBadSCRAMMessage
+	}
+	e.clientFirst = parts[2]
+
+	attrs, err := scramAttrs(e.clientFirst)
+	if err != nil || len(attrs) < 2 || attrs[0][0] != "n" || attrs[1][0] != "r" || attrs[1][1] == "" {
+		return nil, errBadSCRAMMessage
+	}
+
+	user, err := scramUnescape(attrs[0][1])
+	if err != nil || user == "" || !validString(user) {
+		return nil, errBadSCRAMMessage
+	}
+
+	e.creds, err = e.store.LookupSCRAM(user)
+	switch err {
+	case nil:
+	case ErrBadCredentials:
+		// go on and fail at the final step as with wrong password
+		e.creds = scramUnknownUser(user)
+	default:
+		return nil, err
+	}
+	e.info.Username = user
+
+	nonce := make([]byte, scramNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	e.nonce = attrs[1][1] + base64.RawStdEncoding.EncodeToString(nonce)
+
+	e.serverFirst = "r=" + e.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(e.creds.Salt) +
+		",i=" + strconv.Itoa(e.creds.Iterations)
+	return []byte(e.serverFirst), nil
+}
+
+// final handles "c=<channel binding>,r=<nonce>,p=<client proof>" and
+// answers with "v=<server signature>"
+func (e *scramExchange) final(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errBadSCRAMMessage
+	}
+
+	attrs, err := scramAttrs(msg[:i])
+	if err != nil || len(attrs) < 2 || attrs[0][0] != "c" || attrs[1][0] != "r" {
+		return nil, errBadSCRAMMessage
+	}
+
+	// base64 of the gs2 header
+	if attrs[0][1] != "biws" && attrs[0][1] != "eSws" {
+		return nil, errBadSCRAMMessage
+	}
+
+	if attrs[1][1] != e.nonce {
+		return nil, ErrBadCredentials
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errBadSCRAMMessage
+	}
+
+	authMessage := e.clientFirst + "," + e.serverFirst + "," + msg[:i]
+	clientSignature := scramHMAC(e.creds.StoredKey, authMessage)
+	for j := range proof {
+		proof[j] ^= clientSignature[j]
+	}
+
+	// proof is now the client key
+	storedKey := sha256.Sum256(proof)
+	if subtle.ConstantTimeCompare(storedKey[:], e.creds.StoredKey) != 1 {
+		return nil, ErrBadCredentials
+	}
+
+	serverSignature := scramHMAC(e.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramUnknownUser returns credentials of unknown user, salt and iterations
+// look like those of known users, no client proof matches the stored key
+func scramUnknownUser(username string) *SCRAMCredentials {
+	return &SCRAMCredentials{
+		Salt:       scramHMAC(scramFakeKey, "Salt\x00"+username)[:pbkdf2SaltLen],
+		Iterations: pbkdf2Iterations,
+		StoredKey:  scramHMAC(scramFakeKey, "Stored Key\x00"+username),
+		ServerKey:  scramHMAC(scramFakeKey, "Server Key\x00"+username),
+	}
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramAttrs splits message into attribute name and value pairs
+func scramAttrs(msg string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) < 2 || a[1] != '=' {
+			return nil, errBadSCRAMMessage
+		}
+		attrs = append(attrs, [2]string{a[:1], a[2:]})
+	}
+	return attrs, nil
+}
+
+// scramUnescape decodes "=2C" and "=3D" in username
+func scramUnescape(s string) (string, error) {
+	if !strings.Contains(s, "=") {
+		return s, nil
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", errBadSCRAMMessage
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramTestFile has users of pbkdf2 hash, "alice" with password "pencil"
+// and salt of RFC 7677, and "bob" of bcrypt hash
+func scramTestFile(t *testing.T) *PasswordFile {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	key := pbkdf2.Key([]byte("pencil"), salt, 4096, sha256.Size, sha256.New)
+	return &PasswordFile{users: map[string]string{
+		"alice": fmt.Sprintf("$%s$i=4096$%s$%s", HashPBKDF2,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)),
+		"bob": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga",
+	}}
+}
+
+// scramClientFinal creates client final message of password answering
+// server first message
+func scramClientFinal(t *testing.T, password, clientFirst, serverFirst string) string {
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil || len(attrs) != 3 {
+		t.Fatalf("bad server first message %q", serverFirst)
+	}
+
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1][1])
+	iter, _ := strconv.Atoi(attrs[2][1])
+	salted := pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New)
+	withoutProof := "c=biws,r=" + attrs[0][1]
+	creds := newSCRAMCredentials(salt, iter, salted)
+	proof := scramHMAC(salted, "Client Key")
+	signature := scramHMAC(creds.StoredKey, clientFirst+","+serverFirst+","+withoutProof)
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+}
+
+func TestSCRAMVector(t *testing.T) {
+	// RFC 7677 section 3
+	const (
+		clientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+		serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		clientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+		serverFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	)
+
+	f := scramTestFile(t)
+	f.users["user"] = f.users["alice"]
+	e := (&SCRAMSHA256{Store: f}).NewExchange(&AuthInfo{}).(*scramExchange)
+	if _, done, err := e.Next([]byte(clientFirst)); done || err != nil {
+		t.Fatalf("client first: got %v, %v, want false, nil", done, err)
+	}
+
+	// server nonce is random, use the one of the vector
+	e.nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	e.serverFirst = serverFirst
+
+	resp, done, err := e.Next([]byte(clientFinal))
+	if string(resp) != serverFinal || !done || err != nil {
+		t.Errorf("client final: got %q, %v, %v, want %q, true, nil", resp, done, err, serverFinal)
+	}
+	if e.info.Username != "user" {
+		t.Errorf("got username %q, want %q", e.info.Username, "user")
+	}
+}
+
+func TestSCRAMExchange(t *testing.T) {
+	m := &SCRAMSHA256{Store: scramTestFile(t)}
+	cases := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "pencil", nil},
+		{"alice", "pen", ErrBadCredentials},
+		// unknown users and users without pbkdf2 hash fail at the final step
+		{"bob", "allmine", ErrBadCredentials},
+		{"carol", "pencil", ErrBadCredentials},
+	}
+
+	for _, c := range cases {
+		e := m.NewExchange(&AuthInfo{})
+		clientFirst := "n=" + c.username + ",r=nonce"
+		serverFirst, done, err := e.Next([]byte("n,," + clientFirst))
+		if done || err != nil {
+			t.Errorf("%s: client first got %v, %v, want false, nil", c.username, done, err)
+			continue
+		}
+
+		if !strings.HasPrefix(string(serverFirst), "r=nonce") {
+			t.Errorf("%s: got server first %q, want client nonce prefix", c.username, serverFirst)
+		}
+
+		_, done, err = e.Next([]byte(scramClientFinal(t, c.password, clientFirst, string(serverFirst))))
+		if err != c.err || done != (c.err == nil) {
+			t.Errorf("%s: client final got %v, %v, want %v, %v", c.username, done, err, c.err == nil, c.err)
+		}
+	}
+}
+
+func TestSCRAMUnknownUser(t *testing.T) {
+	m := &SCRAMSHA256{Store: scramTestFile(t)}
+	serverFirst := func(username string) [][2]string {
+		resp, _, err := m.NewExchange(&AuthInfo{}).Next([]byte("n,,n=" + username + ",r=nonce"))
+		if err != nil {
+			t.Fatalf("%s: %v", username, err)
+		}
+		attrs, err := scramAttrs(string(resp))
+		if err != nil || len(attrs) != 3 {
+			t.Fatalf("%s: bad server first message %q", username, resp)
+		}
+		return attrs
+	}
+
+	known, unknown := serverFirst("alice"), serverFirst("carol")
+	salt, _ := base64.StdEncoding.DecodeString(unknown[1][1])
+	if len(salt) != pbkdf2SaltLen || unknown[2][1] != strconv.Itoa(pbkdf2Iterations) {
+		t.Errorf("unknown user: got salt %q, iterations %s, want %d bytes, %d", unknown[1][1], unknown[2][1], pbkdf2SaltLen, pbkdf2Iterations)
+	}
+
+	// salt does not change between exchanges
+	if again := serverFirst("carol"); again[1] != unknown[1] {
+		t.Errorf("unknown user: got salt %q then %q", unknown[1][1], again[1][1])
+	}
+	if other := serverFirst("dave"); other[1] == unknown[1] {
+		t.Errorf("unknown users: got same salt %q", other[1][1])
+	}
+	if known[1] == unknown[1] {
+		t.Errorf("got same salt %q of known and unknown user", known[1][1])
+	}
+}
+
+func TestSCRAMBadMessage(t *testing.T) {
+	m := &SCRAMSHA256{Store: scramTestFile(t)}
+	for _, msg := range []string{
+		"",
+		"p=tls-server-end-point,,n=alice,r=nonce",
+		"n,a=admin,n=alice,r=nonce",
+		"n,,r=nonce,n=alice",
+		"n,,n=alice",
+		"n,,n=alice,r=",
+		"n,,n=,r=nonce",
+		"n,,n=al=2Xice,r=nonce",
+	} {
+		if _, _, err := m.NewExchange(&AuthInfo{}).Next([]byte(msg)); err != errBadSCRAMMessage {
+			t.Errorf("%q: got %v, want %v", msg, err, errBadSCRAMMessage)
+		}
+	}
+
+	e := m.NewExchange(&AuthInfo{})
+	serverFirst, _, err := e.Next([]byte("n,,n=alice,r=nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := strings.SplitN(string(serverFirst), ",", 2)[0]
+	for _, msg := range []string{
+		"c=biws," + nonce,
+		"c=cD10bHM," + nonce + ",p=AAAA",
+		"c=biws," + nonce + ",p=AAAA",
+	} {
+		if _, err := e.(*scramExchange).final(msg); err != errBadSCRAMMessage {
+			t.Errorf("%q: got %v, want %v", msg, err, errBadSCRAMMessage)
+		}
+	}
+
+	if _, _, err := e.Next([]byte("c=biws,r=other,p=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))); err != ErrBadCredentials {
+		t.Errorf("nonce mismatch: got %v, want %v", err, ErrBadCredentials)
+	}
+}
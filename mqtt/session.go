@@ -0,0 +1,705 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// session expiry interval of sessions never expire, used by persistent
+// sessions of mqtt 3.1.1
+const expiryNever = 0xffffffff
+
+// user property of persisted session record, unix time when the session
+// went offline
+const propOfflineAt = "offline_at"
+
+// session is the server side state of one client, it may outlive
+// the network connection when clean session is not set, state of
+// such session is saved with the configured persist method
+type session struct {
+	srv      *Server
+	clientID string
+
+	mu     sync.Mutex
+	clean  bool                  // discard session when connection closed
+	ended  bool                  // session has ended and been removed
+	expiry uint32                // session expiry interval in seconds
+	conn   *connImpl             // connection currently bound, nil if offline
+	subs   map[string]subOptions // topic filter -> subscription options
+	out    *inflight             // outbound qos 1 and qos 2 messages
+	in     map[uint16]struct{}   // inbound qos 2 packet ids waiting for pubrel
+
+	offlineAt   time.Time   // when session went offline, zero if online
+	expireAt    time.Time   // when offline session expires
+	expireTimer *time.Timer // timer to expire offline session
+	will        *willMsg    // will message waiting for its delay
+	willTimer   *time.Timer // timer to publish delayed will message
+}
+
+// newSession creates a clean session, call setExpiry to make it persistent
+func newSession(srv *Server, clientID string) *session {
+	return &session{
+		srv:      srv,
+		clientID: clientID,
+		clean:    true,
+		subs:     make(map[string]subOptions),
+		out:      newInflight(),
+		in:       make(map[uint16]struct{}),
+	}
+}
+
+type sessionStore struct {
+	srv      *Server
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore(srv *Server) *sessionStore {
+	return &sessionStore{
+		srv:      srv,
+		sessions: make(map[string]*session),
+	}
+}
+
+// load sessions saved by persist method
+func (s *sessionStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.srv.persist.Range(func(key string, pkt mqtt.Packet) bool {
+		kind, clientID, id, ok := parsePersistKey(key)
+		if !ok {
+			return true
+		}
+
+		switch kind {
+		case keySession, keySubs, keyOutbound, keyQueued, keyInbound:
+		default:
+			return true
+		}
+
+		sess, ok := s.sessions[clientID]
+		if !ok {
+			// expiry interval is restored from session record,
+			// sessions without it are kept until resumed
+			sess = newSession(s.srv, clientID)
+			sess.clean, sess.expiry = false, expiryNever
+			s.sessions[clientID] = sess
+		}
+		sess.restore(kind, id, pkt)
+		return true
+	})
+
+	// sessions online when server stopped go offline now
+	now, expired := time.Now(), 0
+	for _, sess := range s.sessions {
+		sess.out.sortQueue()
+		if sess.expiry == expiryNever {
+			continue
+		}
+
+		if deadline := sess.offline(now); deadline.After(now) {
+			sess.startExpire(deadline, s.expire)
+		} else {
+			s.end(sess)
+			expired++
+		}
+	}
+	s.srv.log.Info("persisted sessions loaded", zap.Int("count", len(s.sessions)), zap.Int("expired", expired))
+}
+
+// conns returns connections bound to sessions
+func (s *sessionStore) conns() []*connImpl {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*connImpl, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		if sess.conn != nil {
+			conns = append(conns, sess.conn)
+		}
+		sess.mu.Unlock()
+	}
+	return conns
+}
+
+// stopTimers stops expiry and will delay timers of all sessions, so that
+// nothing is published or persisted after the server has shut down
+func (s *sessionStore) stopTimers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		if sess.expireTimer != nil {
+			sess.expireTimer.Stop()
+			sess.expireTimer = nil
+		}
+		sess.stopWill()
+		sess.mu.Unlock()
+	}
+}
+
+// open the session for client connection, discard any existing session
+// when clean start is set, session is kept after connection closed for
+// expiry seconds, present reports whether an existing session has been
+// resumed, prev is the connection using the client id before, which
+// must be disconnected by caller as its session has been taken over
+func (s *sessionStore) open(c *connImpl, cleanStart bool, expiry uint32) (present bool, prev *connImpl) {
+	s.mu.Lock()
+
+	var will *willMsg
+	if old, ok := s.sessions[c.clientID]; ok {
+		old.stopExpire()
+		if !cleanStart {
+			old.cancelWill()
+			old.setExpiry(expiry)
+			c.session = old
+			prev, c.pending = old.bind(c)
+			s.mu.Unlock()
+			return true, prev
+		}
+
+		// the old session ends here
+		prev, _ = old.bind(nil)
+		will = s.end(old)
+	}
+
+	c.session = newSession(s.srv, c.clientID)
+	c.session.setExpiry(expiry)
+	c.session.bind(c)
+	s.sessions[c.clientID] = c.session
+	s.mu.Unlock()
+
+	if will != nil {
+		will.publish(s.srv, c.clientID)
+	}
+	return false, prev
+}
+
+// get the session of client, nil if not exists
+func (s *sessionStore) get(clientID string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions[clientID]
+}
+
+// release the session when its connection closed, clean session ends
+// immediately and others expire after their expiry interval
+func (s *sessionStore) release(sess *session) {
+	if sess == nil {
+		return
+	}
+
+	s.mu.Lock()
+
+	// session may have been replaced or resumed by a newer connection
+	var will *willMsg
+	if s.sessions[sess.clientID] == sess {
+		sess.mu.Lock()
+		attached, clean, expiry := sess.conn != nil, sess.clean, sess.expiry
+		sess.mu.Unlock()
+
+		switch {
+		case attached:
+		case clean:
+			will = s.end(sess)
+		case expiry != expiryNever:
+			sess.startExpire(sess.offline(time.Now()), s.expire)
+		}
+	}
+	s.mu.Unlock()
+
+	if will != nil {
+		will.publish(s.srv, sess.clientID)
+	}
+}
+
+// expire the offline session if it has not been resumed before deadline
+func (s *sessionStore) expire(sess *session, deadline time.Time) {
+	s.mu.Lock()
+
+	sess.mu.Lock()
+	expired := sess.conn == nil && sess.expireAt.Equal(deadline)
+	sess.mu.Unlock()
+
+	var will *willMsg
+	if expired && s.sessions[sess.clientID] == sess {
+		s.srv.log.Debug("session expired", zap.String("client", sess.clientID))
+		will = s.end(sess)
+	}
+	s.mu.Unlock()
+
+	if will != nil {
+		will.publish(s.srv, sess.clientID)
+	}
+}
+
+// end the session and return its pending will message, which must be
+// published after the store is unlocked
+func (s *sessionStore) end(sess *session) *willMsg {
+	delete(s.sessions, sess.clientID)
+	will := sess.takeWill(nil)
+	sess.clear()
+	return will
+}
+
+// bind the connection to session, return the connection bound before
+// and messages not acknowledged in previous connection, which are to be
+// retransmitted after connack
+func (s *session) bind(c *connImpl) (*connImpl, []mqtt.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.conn
+	s.conn = c
+	if c == nil {
+		return prev, nil
+	}
+	s.out.window = c.receiveMax()
+	return prev, s.out.pending()
+}
+
+// detach the connection from session if it is still bound
+func (s *session) detach(c *connImpl) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == c {
+		s.conn = nil
+	}
+}
+
+// subscribe to the topic filter, return true if the subscription is new
+func (s *session) subscribe(filter string, opts subOptions) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, existed := s.subs[filter]
+	s.subs[filter] = opts
+	s.srv.subs.subscribe(filter, s.clientID, opts)
+	s.storeSubs()
+	return !existed
+}
+
+func (s *session) unsubscribe(filter string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subs, filter)
+	s.storeSubs()
+	return s.srv.subs.unsubscribe(filter, s.clientID)
+}
+
+// deliver message to the client, qos is downgraded to the granted qos
+// of subscription, qos 1 and qos 2 messages are kept until acknowledged
+// and are retained for offline clients with persistent session
+func (s *session) deliver(pkt *mqtt.PublishPacket, granted mqtt.QosLevel, retain bool) {
+	msg := &mqtt.PublishPacket{
+		Qos:       pkt.Qos,
+		IsRetain:  retain,
+		TopicName: pkt.TopicName,
+		Payload:   pkt.Payload,
+		Props:     pkt.Props,
+	}
+	if granted < msg.Qos {
+		msg.Qos = granted
+	}
+
+	s.mu.Lock()
+	c := s.conn
+	if msg.Qos == mqtt.Qos0 || (c == nil && s.clean) {
+		s.mu.Unlock()
+		if c != nil {
+			c.publish(msg)
+		}
+		return
+	}
+
+	m, sendNow := s.out.push(msg, c != nil)
+	if sendNow {
+		s.store(persistKey(keyOutbound, s.clientID, uint64(msg.PacketID)), msg)
+	} else {
+		s.store(persistKey(keyQueued, s.clientID, m.seq), msg)
+	}
+	s.mu.Unlock()
+
+	if sendNow && c != nil {
+		c.publish(msg)
+	}
+}
+
+// ackPub handles puback of qos 1 message
+func (s *session) ackPub(id uint16) {
+	s.mu.Lock()
+	ok := s.out.ack(id, stateWaitAck)
+	if ok {
+		s.remove(persistKey(keyOutbound, s.clientID, uint64(id)))
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.flush()
+	}
+}
+
+// recPub handles pubrec of qos 2 message,
+// return false if no message is waiting for it
+func (s *session) recPub(id uint16, code byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := persistKey(keyOutbound, s.clientID, uint64(id))
+	if code >= mqtt.CodeUnspecifiedError {
+		// delivery refused by client (mqtt 5)
+		s.out.drop(id)
+		s.remove(key)
+		return false
+	}
+
+	if !s.out.ack(id, stateWaitRec) {
+		return false
+	}
+
+	s.store(key, &mqtt.PubRelPacket{PacketID: id})
+	return true
+}
+
+// compPub handles pubcomp of qos 2 message
+func (s *session) compPub(id uint16) {
+	s.mu.Lock()
+	ok := s.out.ack(id, stateWaitComp)
+	if ok {
+		s.remove(persistKey(keyOutbound, s.clientID, uint64(id)))
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.flush()
+	}
+}
+
+// discard outbound message which can't be sent to client of connection
+// c, its delivery ends as if acknowledged, return packets to send for
+// the room made, which are sent by the caller being the send loop of c
+func (s *session) discard(c *connImpl, id uint16) []mqtt.Packet {
+	s.mu.Lock()
+	s.out.drop(id)
+	s.remove(persistKey(keyOutbound, s.clientID, uint64(id)))
+	if s.conn != c {
+		// session taken over or released, not sent by c
+		s.mu.Unlock()
+		s.flush()
+		return nil
+	}
+
+	pkts, msgs := s.next(true)
+	s.mu.Unlock()
+
+	for _, msg := range msgs {
+		pkts = append(pkts, msg.pkt)
+	}
+	return pkts
+}
+
+// flush queued messages when inflight window has room
+func (s *session) flush() {
+	s.mu.Lock()
+	c := s.conn
+	held, msgs := s.next(c != nil)
+	s.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	for _, pkt := range held {
+		c.send(pkt)
+	}
+	for _, msg := range msgs {
+		c.publish(msg.pkt)
+	}
+}
+
+// next returns held packets to resend and queued messages to publish
+// while inflight window has room, online tells whether they are sent
+// to client, s.mu must be held
+func (s *session) next(online bool) ([]mqtt.Packet, []*inflightMsg) {
+	var held []mqtt.Packet
+	if online {
+		held = s.out.release()
+	}
+
+	msgs := s.out.pop(online)
+	for _, msg := range msgs {
+		s.remove(persistKey(keyQueued, s.clientID, msg.seq))
+		s.store(persistKey(keyOutbound, s.clientID, uint64(msg.pkt.PacketID)), msg.pkt)
+	}
+	return held, msgs
+}
+
+// recvQos2 records inbound qos 2 packet id,
+// return false if the message has already been received
+func (s *session) recvQos2(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.in[id]; ok {
+		return false
+	}
+	s.in[id] = struct{}{}
+	s.store(persistKey(keyInbound, s.clientID, uint64(id)), &mqtt.PubRecvPacket{PacketID: id})
+	return true
+}
+
+// recvQuota checks whether inbound qos 1 or qos 2 message is within
+// receive maximum, messages unacknowledged are qos 2 messages waiting
+// for pubrel and the message checked, which takes one more slot, no other
+// qos 1 message is unacknowledged as each is acknowledged before the next
+// packet is read, qos 2 message already received is duplicate and always
+// within it
+func (s *session) recvQuota(id uint16, qos mqtt.QosLevel, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.in[id]; ok && qos == mqtt.Qos2 {
+		return true
+	}
+	return len(s.in) < max
+}
+
+// releaseQos2 completes inbound qos 2 message,
+// return false if the packet id is unknown
+func (s *session) releaseQos2(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.in[id]
+	delete(s.in, id)
+	s.remove(persistKey(keyInbound, s.clientID, uint64(id)))
+	return ok
+}
+
+// offline records when the session went offline and returns when it
+// expires, time recorded before is kept
+func (s *session) offline(now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offlineAt.IsZero() {
+		s.offlineAt = now
+		s.storeSession()
+	}
+	return s.offlineAt.Add(time.Duration(s.expiry) * time.Second)
+}
+
+func (s *session) startExpire(deadline time.Time, expire func(*session, time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireAt = deadline
+	s.expireTimer = time.AfterFunc(time.Until(deadline), func() { expire(s, deadline) })
+}
+
+func (s *session) stopExpire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireTimer != nil {
+		s.expireTimer.Stop()
+		s.expireTimer = nil
+	}
+	s.offlineAt, s.expireAt = time.Time{}, time.Time{}
+}
+
+// clear all subscriptions and persisted state of the session
+func (s *session) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for filter := range s.subs {
+		s.srv.subs.unsubscribe(filter, s.clientID)
+	}
+	s.subs = make(map[string]subOptions)
+	s.ended = true
+
+	if !s.clean {
+		s.removeAll()
+	}
+}
+
+// setExpiry changes session expiry interval, session with non zero
+// interval is persistent and has its whole state saved, state of
+// session changed to 0 is removed from persist method
+func (s *session) setExpiry(expiry uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiry = expiry
+	switch {
+	case expiry == 0 && !s.clean:
+		s.removeAll()
+		s.clean = true
+	case expiry != 0 && s.clean:
+		s.clean = false
+		s.storeAll()
+	case expiry != 0:
+		s.storeSession()
+	}
+}
+
+func (s *session) removeAll() {
+	s.srv.persistDelete(persistKey(keySession, s.clientID))
+	s.srv.persistDelete(persistKey(keySubs, s.clientID))
+	for id := range s.out.msgs {
+		s.srv.persistDelete(persistKey(keyOutbound, s.clientID, uint64(id)))
+	}
+	for _, msg := range s.out.queue {
+		s.srv.persistDelete(persistKey(keyQueued, s.clientID, msg.seq))
+	}
+	for id := range s.in {
+		s.srv.persistDelete(persistKey(keyInbound, s.clientID, uint64(id)))
+	}
+}
+
+func (s *session) storeAll() {
+	s.storeSession()
+	s.storeSubs()
+	for id, msg := range s.out.msgs {
+		if msg.state == stateWaitComp {
+			s.store(persistKey(keyOutbound, s.clientID, uint64(id)), &mqtt.PubRelPacket{PacketID: id})
+		} else {
+			s.store(persistKey(keyOutbound, s.clientID, uint64(id)), msg.pkt)
+		}
+	}
+	for _, msg := range s.out.queue {
+		s.store(persistKey(keyQueued, s.clientID, msg.seq), msg.pkt)
+	}
+	for id := range s.in {
+		s.store(persistKey(keyInbound, s.clientID, uint64(id)), &mqtt.PubRecvPacket{PacketID: id})
+	}
+}
+
+// storeSession saves session record with expiry interval and the time
+// session went offline, which decide when it expires after restart
+func (s *session) storeSession() {
+	props := &mqtt.ConnProps{SessionExpiryInterval: s.expiry}
+	if !s.offlineAt.IsZero() {
+		props.UserProps = mqtt.UserProperties{
+			propOfflineAt: {strconv.FormatInt(s.offlineAt.Unix(), 10)},
+		}
+	}
+
+	s.store(persistKey(keySession, s.clientID), &mqtt.ConnPacket{
+		ProtoName: protoName,
+		ClientID:  s.clientID,
+		Props:     props,
+	})
+}
+
+func (s *session) storeSubs() {
+	key := persistKey(keySubs, s.clientID)
+	if len(s.subs) == 0 {
+		s.remove(key)
+		return
+	}
+
+	pkt := &subscribePacket{}
+	for filter, opts := range s.subs {
+		pkt.Topics = append(pkt.Topics, &mqtt.Topic{Name: filter, Qos: opts.qos()})
+		pkt.Options = append(pkt.Options, opts)
+	}
+	s.store(key, pkt)
+}
+
+// restore session state loaded from persist method
+func (s *session) restore(kind string, id uint64, pkt mqtt.Packet) {
+	switch p := pkt.(type) {
+	case *mqtt.ConnPacket:
+		if p.Props == nil || p.Props.SessionExpiryInterval == 0 {
+			return
+		}
+
+		s.expiry = p.Props.SessionExpiryInterval
+		if v := p.Props.UserProps[propOfflineAt]; len(v) > 0 {
+			if sec, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+				s.offlineAt = time.Unix(sec, 0)
+			}
+		}
+	case *subscribePacket:
+		for i, t := range p.Topics {
+			s.subs[t.Name] = p.Options[i]
+			s.srv.subs.subscribe(t.Name, s.clientID, p.Options[i])
+		}
+	case *mqtt.PublishPacket:
+		msg := &inflightMsg{seq: id, pkt: p, sent: true, state: stateWaitAck}
+		if p.Qos == mqtt.Qos2 {
+			msg.state = stateWaitRec
+		}
+
+		if kind == keyQueued {
+			msg.sent = false
+			s.out.restore(msg, 0)
+		} else {
+			s.out.restore(msg, uint16(id))
+		}
+	case *mqtt.PubRelPacket:
+		s.out.restore(&inflightMsg{
+			seq:   id,
+			state: stateWaitComp,
+			sent:  true,
+			pkt:   &mqtt.PublishPacket{Qos: mqtt.Qos2},
+		}, uint16(id))
+	case *mqtt.PubRecvPacket:
+		s.in[uint16(id)] = struct{}{}
+	}
+}
+
+// store session state when session is persistent
+func (s *session) store(key string, pkt mqtt.Packet) {
+	if !s.clean {
+		s.srv.persistStore(key, pkt)
+	}
+}
+
+func (s *session) remove(key string) {
+	if !s.clean {
+		s.srv.persistDelete(key)
+	}
+}
+
+// publish message sent by the client to all matching subscribers, the
+// retain flag is only kept for subscriptions with retain as published
+func (s *Server) publish(pkt *mqtt.PublishPacket, clientID string) {
+	for id, opts := range s.subs.match(pkt.TopicName) {
+		if id == clientID && opts&subNoLocal != 0 {
+			continue
+		}
+
+		if sess := s.sessions.get(id); sess != nil {
+			sess.deliver(pkt, opts.qos(), pkt.IsRetain && opts&subRetainAsPublished != 0)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+func TestSessionLoadExpiry(t *testing.T) {
+	persist, err := persistMethods["mem"](&Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{log: zap.NewNop(), subs: newSubTree(), persist: persist}
+	srv.sessions = newSessionStore(srv)
+
+	now := time.Now()
+	record := func(clientID string, expiry uint32, offline time.Time) {
+		props := &mqtt.ConnProps{SessionExpiryInterval: expiry}
+		if !offline.IsZero() {
+			props.UserProps = mqtt.UserProperties{propOfflineAt: {strconv.FormatInt(offline.Unix(), 10)}}
+		}
+		persist.Store(persistKey(keySession, clientID), &mqtt.ConnPacket{ClientID: clientID, Props: props})
+		persist.Store(persistKey(keySubs, clientID), &mqtt.SubscribePacket{
+			Topics: []*mqtt.Topic{{Name: "t/" + clientID, Qos: mqtt.Qos1}},
+		})
+	}
+	record("expired", 60, now.Add(-time.Hour))
+	record("offline", 3600, now.Add(-time.Minute))
+	record("online", 60, time.Time{})
+	record("never", expiryNever, time.Time{})
+	srv.sessions.load()
+
+	if sess := srv.sessions.get("expired"); sess != nil {
+		t.Error("expired session restored")
+	}
+	if _, ok := persist.Load(persistKey(keySubs, "expired")); ok {
+		t.Error("state of expired session not removed")
+	}
+	if subs := srv.subs.match("t/expired"); len(subs) != 0 {
+		t.Errorf("subscriptions of expired session restored: %v", subs)
+	}
+
+	deadline := func(clientID string) time.Time {
+		sess := srv.sessions.get(clientID)
+		if sess == nil {
+			t.Fatalf("session %s not restored", clientID)
+		}
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		return sess.expireAt
+	}
+
+	// offline time is stored with second precision
+	if got, want := deadline("offline"), now.Add(59*time.Minute); got.After(want) || want.Sub(got) >= time.Second {
+		t.Errorf("offline: expires at %v, want %v", got, want)
+	}
+	if got := deadline("online"); got.Before(now.Add(59 * time.Second)) {
+		t.Errorf("online: expires at %v, want a minute after load", got)
+	}
+	if got := deadline("never"); !got.IsZero() {
+		t.Errorf("never: expires at %v, want never", got)
+	}
+
+	// offline time of session online before restart is saved
+	pkt, ok := persist.Load(persistKey(keySession, "online"))
+	if !ok || len(pkt.(*mqtt.ConnPacket).Props.UserProps[propOfflineAt]) == 0 {
+		t.Errorf("online: offline time not saved, record %+v", pkt)
+	}
+}
+
+func TestSessionRecvQuota(t *testing.T) {
+	srv := &Server{log: zap.NewNop(), persist: mqtt.NonePersist}
+	sess := newSession(srv, "c1")
+	sess.recvQos2(1)
+	sess.recvQos2(2)
+
+	cases := []struct {
+		id   uint16
+		qos  mqtt.QosLevel
+		max  int
+		want bool
+	}{
+		{3, mqtt.Qos2, 3, true},
+		{3, mqtt.Qos1, 3, true},
+		{3, mqtt.Qos2, 2, false},
+		// qos 1 counts as well
+		{3, mqtt.Qos1, 2, false},
+		// duplicate of qos 2 message received
+		{2, mqtt.Qos2, 2, true},
+		// qos 1 reusing packet id of qos 2 message is a new message
+		{2, mqtt.Qos1, 2, false},
+	}
+
+	for _, c := range cases {
+		if got := sess.recvQuota(c.id, c.qos, c.max); got != c.want {
+			t.Errorf("id %d qos %d max %d: got %v, want %v", c.id, c.qos, c.max, got, c.want)
+		}
+	}
+}
+
+func TestSessionStopTimers(t *testing.T) {
+	srv := &Server{log: zap.NewNop(), subs: newSubTree(), persist: mqtt.NonePersist}
+	srv.sessions = newSessionStore(srv)
+
+	sess := newSession(srv, "c1")
+	srv.sessions.sessions[sess.clientID] = sess
+	sess.startExpire(time.Now().Add(time.Hour), srv.sessions.expire)
+	sess.setWill(&willMsg{pkt: &mqtt.PublishPacket{TopicName: "w"}, delay: 3600})
+
+	srv.sessions.stopTimers()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.expireTimer != nil || sess.willTimer != nil {
+		t.Error("session timers not stopped")
+	}
+}
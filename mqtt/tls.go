@@ -0,0 +1,263 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// client certificate verification modes
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+// client certificate fields used as client identity
+const (
+	CertFieldCN  = "cn"
+	CertFieldSAN = "san"
+)
+
+var (
+	errNoCACert       = errors.New("no ca certificate found in ca bundle")
+	errSNIKeyMismatch = errors.New("count of sni certs and keys mismatch")
+)
+
+// tlsConfig creates tls config shared by tcps and wss services
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		Rand:           rand.Reader,
+	}
+
+	switch s.opts.TLSClientAuth {
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return config, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(s.opts.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errNoCACert
+	}
+	return config, nil
+}
+
+// peerCert returns verified certificate of the client, nil if the client
+// is not connected with tls or has no certificate
+func peerCert(conn net.Conn) *x509.Certificate {
+	for {
+		switch c := conn.(type) {
+		case *limitedConn:
+			conn = c.Conn
+		case *wsConn:
+			conn = c.UnderlyingConn()
+		case *tls.Conn:
+			certs := c.ConnectionState().PeerCertificates
+			if len(certs) == 0 {
+				return nil
+			}
+			return certs[0]
+		default:
+			return nil
+		}
+	}
+}
+
+// certIdentity returns the certificate field used as client identity,
+// subject alternative name is the first dns name, email or uri
+func certIdentity(cert *x509.Certificate, field string) string {
+	switch field {
+	case CertFieldCN:
+		return cert.Subject.CommonName
+	case CertFieldSAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// initCerts loads server certificates and watches the files for change
+func (s *Server) initCerts(exit context.Context) error {
+	if len(s.opts.TLSSNICerts) != len(s.opts.TLSSNIKeys) {
+		return errSNIKeyMismatch
+	}
+
+	pairs := []certPair{{s.opts.TLSCertFile, s.opts.TLSKeyFile}}
+	for i := range s.opts.TLSSNICerts {
+		pairs = append(pairs, certPair{s.opts.TLSSNICerts[i], s.opts.TLSSNIKeys[i]})
+	}
+
+	if err := s.certs.init(pairs); err != nil {
+		return err
+	}
+
+	if s.opts.TLSReloadInterval > 0 {
+		go s.certs.watch(exit, s.opts.TLSReloadInterval)
+	}
+	return nil
+}
+
+// ReloadCerts reloads server certificates from files, connections already
+// established keep using the certificate they were accepted with
+func (s *Server) ReloadCerts() {
+	s.certs.reloadOrLog()
+}
+
+type certPair struct {
+	certFile, keyFile string
+}
+
+// certStore holds server certificates, the first one is the default
+// certificate for clients without matching server name (SNI)
+type certStore struct {
+	log     *zap.Logger
+	mu      sync.RWMutex
+	pairs   []certPair
+	certs   []tls.Certificate
+	modTime map[string]time.Time // modify time of files loaded
+}
+
+func (s *certStore) init(pairs []certPair) error {
+	s.mu.Lock()
+	s.pairs = pairs
+	s.mu.Unlock()
+
+	return s.reload()
+}
+
+// reload all certificates, the loaded ones are kept if any fails
+func (s *certStore) reload() error {
+	s.mu.RLock()
+	pairs := s.pairs
+	s.mu.RUnlock()
+
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	modTime := make(map[string]time.Time)
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		for _, f := range []string{p.certFile, p.keyFile} {
+			info, err := os.Stat(f)
+			if err != nil {
+				return err
+			}
+			modTime[f] = info.ModTime()
+		}
+
+		cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+		if err != nil {
+			return err
+		}
+
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.modTime = modTime
+	s.mu.Unlock()
+
+	s.log.Info("tls certificates loaded", zap.Int("count", len(certs)))
+	return nil
+}
+
+func (s *certStore) reloadOrLog() {
+	if err := s.reload(); err != nil {
+		s.log.Error("reload tls certificates failed", zap.Error(err))
+	}
+}
+
+// changed checks whether any file loaded has been modified
+func (s *certStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for f, t := range s.modTime {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the certificate files and reloads them on change
+func (s *certStore) watch(exit context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exit.Done():
+			return
+		case <-ticker.C:
+			if s.changed() {
+				s.reloadOrLog()
+			}
+		}
+	}
+}
+
+// getCertificate selects certificate by server name of client hello
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for i := range s.certs {
+			cert := &s.certs[i]
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil && hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return &s.certs[0], nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+const (
+	topicSep       = "/"
+	wildcardSingle = "+"
+	wildcardMulti  = "#"
+	sysTopicPrefix = "$"
+)
+
+// subOptions are options of subscription, the lowest 2 bits are the
+// maximum qos, which is the only option of mqtt 3.1.1
+type subOptions byte
+
+const (
+	subNoLocal           subOptions = 0x04 // not forwarded to the publishing client
+	subRetainAsPublished subOptions = 0x08 // retain flag is kept when forwarded
+	subRetainHandling    subOptions = 0x30
+)
+
+// retain handling, when retained messages are sent on subscribe
+const (
+	retainAlways = iota
+	retainIfNew
+	retainNever
+)
+
+func (o subOptions) qos() mqtt.QosLevel {
+	return mqtt.QosLevel(o & 0x03)
+}
+
+func (o subOptions) retainHandling() int {
+	return int(o&subRetainHandling) >> 4
+}
+
+// merge options of overlapping subscriptions, the message is forwarded
+// with the maximum qos and is forwarded to the publishing client unless
+// all subscriptions are no local
+func (o subOptions) merge(other subOptions) subOptions {
+	qos := o.qos()
+	if other.qos() > qos {
+		qos = other.qos()
+	}
+	return subOptions(qos) | (o|other)&subRetainAsPublished | o&other&subNoLocal
+}
+
+// subTree is the subscription index of all clients, topic filters are
+// split into levels and stored as a trie, wildcard levels are ordinary
+// nodes keyed by "+" and "#"
+type subTree struct {
+	mu   sync.RWMutex
+	root *subNode
+}
+
+type subNode struct {
+	children map[string]*subNode
+	subs     map[string]subOptions // client id -> subscription options
+}
+
+func newSubTree() *subTree {
+	return &subTree{root: newSubNode()}
+}
+
+func newSubNode() *subNode {
+	return &subNode{
+		children: make(map[string]*subNode),
+		subs:     make(map[string]subOptions),
+	}
+}
+
+// subscribe client to the topic filter, the filter must be valid,
+// return true if the client was not subscribed to the filter
+func (t *subTree) subscribe(filter, clientID string, opts subOptions) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for _, level := range strings.Split(filter, topicSep) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newSubNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+
+	_, existed := n.subs[clientID]
+	n.subs[clientID] = opts
+	return !existed
+}
+
+// unsubscribe client from the topic filter, nodes left empty are removed,
+// return true if the subscription existed
+func (t *subTree) unsubscribe(filter, clientID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.root.remove(strings.Split(filter, topicSep), clientID)
+}
+
+func (n *subNode) remove(levels []string, clientID string) bool {
+	if len(levels) == 0 {
+		_, existed := n.subs[clientID]
+		delete(n.subs, clientID)
+		return existed
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return false
+	}
+
+	existed := child.remove(levels[1:], clientID)
+	if len(child.subs) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return existed
+}
+
+// match all subscriptions of the topic name, a client with overlapping
+// subscriptions is returned once with their options merged
+func (t *subTree) match(topic string) map[string]subOptions {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make(map[string]subOptions)
+	levels := strings.Split(topic, topicSep)
+	if strings.HasPrefix(topic, sysTopicPrefix) {
+		// topic names starting with $ are not matched by
+		// filters starting with wildcard characters
+		if child, ok := t.root.children[levels[0]]; ok {
+			child.match(levels[1:], result)
+		}
+		return result
+	}
+
+	t.root.match(levels, result)
+	return result
+}
+
+func (n *subNode) match(levels []string, result map[string]subOptions) {
+	// "#" matches the parent level as well as any number of child levels
+	if child, ok := n.children[wildcardMulti]; ok {
+		child.collect(result)
+	}
+
+	if len(levels) == 0 {
+		n.collect(result)
+		return
+	}
+
+	if child, ok := n.children[wildcardSingle]; ok {
+		child.match(levels[1:], result)
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], result)
+	}
+}
+
+func (n *subNode) collect(result map[string]subOptions) {
+	for clientID, opts := range n.subs {
+		if old, ok := result[clientID]; ok {
+			opts = old.merge(opts)
+		}
+		result[clientID] = opts
+	}
+}
+
+// validTopicName checks topic name used in publish packet
+func validTopicName(topic string) bool {
+	return topic != "" && validString(topic) &&
+		!strings.ContainsAny(topic, wildcardSingle+wildcardMulti)
+}
+
+// validTopicFilter checks topic filter used in subscribe packet
+func validTopicFilter(filter string) bool {
+	if filter == "" || !validString(filter) {
+		return false
+	}
+
+	levels := strings.Split(filter, topicSep)
+	for i, level := range levels {
+		switch {
+		case level == wildcardMulti:
+			// multi-level wildcard must be the last level
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == wildcardSingle:
+		case strings.ContainsAny(level, wildcardSingle+wildcardMulti):
+			// wildcard must occupy an entire level
+			return false
+		}
+	}
+	return true
+}
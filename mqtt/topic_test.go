@@ -0,0 +1,141 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+func TestSubTreeMatch(t *testing.T) {
+	tree := newSubTree()
+	subs := []struct {
+		filter, client string
+		qos            mqtt.QosLevel
+	}{
+		{"a/b/c", "exact", mqtt.Qos2},
+		{"a/+/c", "single", mqtt.Qos1},
+		{"a/#", "multi", mqtt.Qos0},
+		{"#", "all", mqtt.Qos0},
+		{"+/b/#", "mixed", mqtt.Qos1},
+		{"$SYS/#", "sys", mqtt.Qos0},
+		{"a/b/c", "overlap", mqtt.Qos0},
+		{"a/#", "overlap", mqtt.Qos2},
+	}
+	for _, s := range subs {
+		tree.subscribe(s.filter, s.client, subOptions(s.qos))
+	}
+
+	cases := []struct {
+		topic string
+		want  map[string]mqtt.QosLevel
+	}{
+		{"a/b/c", map[string]mqtt.QosLevel{
+			"exact": mqtt.Qos2, "single": mqtt.Qos1, "multi": mqtt.Qos0,
+			"all": mqtt.Qos0, "mixed": mqtt.Qos1, "overlap": mqtt.Qos2,
+		}},
+		// "#" matches the parent level
+		{"a", map[string]mqtt.QosLevel{"multi": mqtt.Qos0, "all": mqtt.Qos0, "overlap": mqtt.Qos2}},
+		{"x/b", map[string]mqtt.QosLevel{"all": mqtt.Qos0, "mixed": mqtt.Qos1}},
+		// topics starting with $ are not matched by leading wildcards
+		{"$SYS/uptime", map[string]mqtt.QosLevel{"sys": mqtt.Qos0}},
+	}
+	for _, c := range cases {
+		got := make(map[string]mqtt.QosLevel)
+		for clientID, opts := range tree.match(c.topic) {
+			got[clientID] = opts.qos()
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("match(%q) = %v, want %v", c.topic, got, c.want)
+		}
+	}
+}
+
+func TestSubTreeUnsubscribe(t *testing.T) {
+	tree := newSubTree()
+	if !tree.subscribe("a/+/c", "c1", subOptions(mqtt.Qos1)) {
+		t.Error("first subscribe reported existing subscription")
+	}
+	if tree.subscribe("a/+/c", "c1", subOptions(mqtt.Qos2)) {
+		t.Error("resubscribe reported new subscription")
+	}
+
+	if tree.unsubscribe("a/+", "c1") {
+		t.Error("unsubscribe of unknown filter reported existing subscription")
+	}
+	if !tree.unsubscribe("a/+/c", "c1") {
+		t.Error("unsubscribe reported missing subscription")
+	}
+
+	if got := tree.match("a/b/c"); len(got) != 0 {
+		t.Errorf("match after unsubscribe = %v, want none", got)
+	}
+	if len(tree.root.children) != 0 {
+		t.Error("empty nodes are not removed")
+	}
+}
+
+func TestSubOptionsMerge(t *testing.T) {
+	cases := []struct {
+		a, b, want subOptions
+	}{
+		{1, 2, 2},
+		{subNoLocal | 2, 1, 2},
+		{subNoLocal | 1, subNoLocal, subNoLocal | 1},
+		{subRetainAsPublished, 1, subRetainAsPublished | 1},
+		{retainNever << 4, 0, 0},
+	}
+	for _, c := range cases {
+		if got := c.a.merge(c.b); got != c.want {
+			t.Errorf("%#x merge %#x: got %#x, want %#x", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	names := map[string]bool{
+		"a/b":   true,
+		"/":     true,
+		"":      false,
+		"a/+":   false,
+		"a/#":   false,
+		"a\x00": false,
+	}
+	for name, want := range names {
+		if got := validTopicName(name); got != want {
+			t.Errorf("validTopicName(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	filters := map[string]bool{
+		"a/b":   true,
+		"+":     true,
+		"#":     true,
+		"a/+/#": true,
+		"":      false,
+		"a/#/b": false,
+		"a+/b":  false,
+		"a/b#":  false,
+	}
+	for filter, want := range filters {
+		if got := validTopicFilter(filter); got != want {
+			t.Errorf("validTopicFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
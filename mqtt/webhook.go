@@ -0,0 +1,258 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+
+	// decisions cached before expired ones are purged
+	webhookCacheSize = 10000
+)
+
+// Webhook is an Authenticator and Authorizer calling http endpoints,
+// requests are json posted to the endpoint, answered with status 200
+// or 204 if allowed, 401 for bad username or password and 403 if not
+// authorized, other status and request failures are handled as
+// configured by FailOpen
+//
+// authentication requests are
+//
+//	{"client_id": "", "username": "", "password": "", "addr": "host:port"}
+//
+// where password is base64 encoded, as it is binary data in mqtt 5
+//
+// and authorization requests are
+//
+//	{"client_id": "", "username": "", "addr": "host:port", "topic": "", "action": "publish|subscribe"}
+type Webhook struct {
+	AuthURL  string        // endpoint to authenticate clients, all accepted if empty
+	ACLURL   string        // endpoint to authorize clients, everything allowed if empty
+	Timeout  time.Duration // timeout of each request, 5s if not set
+	AllowTTL time.Duration // time to cache allowed decisions, not cached if 0
+	DenyTTL  time.Duration // time to cache denied decisions, not cached if 0
+	FailOpen bool          // allow when endpoint fails, deny if false
+	Client   *http.Client  // client used to call endpoints, http.DefaultClient if nil
+	Logger   *zap.Logger   // logger for endpoint failures, nothing logged if nil
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]webhookDecision
+}
+
+type webhookRequest struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password []byte `json:"password,omitempty"` // base64 encoded
+	Addr     string `json:"addr"`
+	Topic    string `json:"topic,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+type webhookDecision struct {
+	err    error // nil, ErrBadCredentials or ErrNotAuthorized
+	expire time.Time
+}
+
+// Authenticate calls auth endpoint with client identity
+func (w *Webhook) Authenticate(info *AuthInfo) error {
+	if w.AuthURL == "" {
+		return nil
+	}
+
+	err := w.decide(w.AuthURL, &webhookRequest{
+		ClientID: info.ClientID,
+		Username: info.Username,
+		Password: info.Password,
+		Addr:     addrString(info.Addr),
+	})
+
+	switch err {
+	case nil, ErrBadCredentials, ErrNotAuthorized:
+		return err
+	default:
+		if w.FailOpen {
+			return nil
+		}
+		return err
+	}
+}
+
+// Authorize calls acl endpoint with client identity, topic and action
+func (w *Webhook) Authorize(info *AuthInfo, action ACLAction, topic string) bool {
+	if w.ACLURL == "" {
+		return true
+	}
+
+	req := &webhookRequest{
+		ClientID: info.ClientID,
+		Username: info.Username,
+		Addr:     addrString(info.Addr),
+		Topic:    topic,
+		Action:   "publish",
+	}
+	if action == ACLSubscribe {
+		req.Action = "subscribe"
+	}
+
+	switch w.decide(w.ACLURL, req) {
+	case nil:
+		return true
+	case ErrBadCredentials, ErrNotAuthorized:
+		return false
+	default:
+		return w.FailOpen
+	}
+}
+
+// decide returns cached decision of the request or calls the endpoint
+func (w *Webhook) decide(url string, req *webhookRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	// decisions are cached by host of client, not the port
+	keyReq := *req
+	keyReq.Addr, _, _ = net.SplitHostPort(req.Addr)
+	keyBody, _ := json.Marshal(&keyReq)
+	key := sha256.Sum256(append([]byte(url+"\n"), keyBody...))
+
+	if d, ok := w.cached(key); ok {
+		return d.err
+	}
+
+	err = w.call(url, body)
+	switch err {
+	case nil:
+		w.store(key, err, w.AllowTTL)
+	case ErrBadCredentials, ErrNotAuthorized:
+		w.store(key, err, w.DenyTTL)
+	default:
+		if w.Logger != nil {
+			w.Logger.Error("call webhook failed", zap.String("url", url), zap.Error(err))
+		}
+	}
+	return err
+}
+
+func (w *Webhook) call(url string, body []byte) error {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain body to reuse the connection
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrBadCredentials
+	case http.StatusForbidden:
+		return ErrNotAuthorized
+	default:
+		return fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+}
+
+func (w *Webhook) cached(key [sha256.Size]byte) (webhookDecision, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	d, ok := w.cache[key]
+	if ok && time.Now().After(d.expire) {
+		delete(w.cache, key)
+		return d, false
+	}
+	return d, ok
+}
+
+func (w *Webhook) store(key [sha256.Size]byte, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.cache == nil {
+		w.cache = make(map[[sha256.Size]byte]webhookDecision)
+	} else if len(w.cache) >= webhookCacheSize {
+		for k, d := range w.cache {
+			if now.After(d.expire) {
+				delete(w.cache, k)
+			}
+		}
+
+		if len(w.cache) >= webhookCacheSize {
+			// still full, start over rather than growing without limit
+			w.cache = make(map[[sha256.Size]byte]webhookDecision)
+		}
+	}
+	w.cache[key] = webhookDecision{err: err, expire: now.Add(ttl)}
+}
+
+// Reload drops all cached decisions
+func (w *Webhook) Reload() error {
+	w.mu.Lock()
+	w.cache = nil
+	w.mu.Unlock()
+	return nil
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
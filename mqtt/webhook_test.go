@@ -0,0 +1,191 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookServer answers requests by username, and allows only
+// publishing to topic "allowed" for acl requests
+func newWebhookServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		var req webhookRequest
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request of %q, want json post", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if len(req.Password) > 0 && string(req.Password) != "secret\xff" {
+			t.Errorf("got password %q, want %q", req.Password, "secret\xff")
+		}
+
+		switch req.Username {
+		case "allow":
+			if req.Topic != "" && (req.Topic != "allowed" || req.Action != "publish") {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		case "allow-empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "bad":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "deny":
+			w.WriteHeader(http.StatusForbidden)
+		case "slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestWebhookAuthenticate(t *testing.T) {
+	var calls int32
+	ts := newWebhookServer(t, &calls)
+	defer ts.Close()
+
+	cases := []struct {
+		username string
+		failOpen bool
+		want     error
+		failed   bool // error other than the decisions
+	}{
+		{"allow", false, nil, false},
+		{"allow-empty", false, nil, false},
+		{"bad", false, ErrBadCredentials, false},
+		{"deny", false, ErrNotAuthorized, false},
+		{"deny", true, ErrNotAuthorized, false},
+		{"error", false, nil, true},
+		{"error", true, nil, false},
+		{"slow", false, nil, true},
+		{"slow", true, nil, false},
+	}
+
+	for _, c := range cases {
+		w := &Webhook{AuthURL: ts.URL, Timeout: 50 * time.Millisecond, FailOpen: c.failOpen}
+		err := w.Authenticate(&AuthInfo{
+			ClientID: "c1",
+			Username: c.username,
+			Password: []byte("secret\xff"),
+			Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883},
+		})
+
+		switch {
+		case c.failed:
+			if err == nil || err == ErrBadCredentials || err == ErrNotAuthorized {
+				t.Errorf("%s (fail open %v): got %v, want request failure", c.username, c.failOpen, err)
+			}
+		case err != c.want:
+			t.Errorf("%s (fail open %v): got %v, want %v", c.username, c.failOpen, err, c.want)
+		}
+	}
+
+	// nothing is called without endpoint
+	atomic.StoreInt32(&calls, 0)
+	err := (&Webhook{}).Authenticate(&AuthInfo{Username: "deny"})
+	if n := atomic.LoadInt32(&calls); err != nil || n != 0 {
+		t.Errorf("no endpoint: got %v with %d calls, want nil without calls", err, n)
+	}
+}
+
+func TestWebhookAuthorize(t *testing.T) {
+	var calls int32
+	ts := newWebhookServer(t, &calls)
+	defer ts.Close()
+
+	cases := []struct {
+		username string
+		action   ACLAction
+		topic    string
+		failOpen bool
+		want     bool
+	}{
+		{"allow", ACLPublish, "allowed", false, true},
+		{"allow", ACLSubscribe, "allowed", false, false},
+		{"allow", ACLPublish, "other", false, false},
+		{"deny", ACLPublish, "allowed", true, false},
+		{"bad", ACLPublish, "allowed", true, false},
+		{"error", ACLPublish, "allowed", false, false},
+		{"error", ACLPublish, "allowed", true, true},
+		{"slow", ACLPublish, "allowed", false, false},
+		{"slow", ACLPublish, "allowed", true, true},
+	}
+
+	for _, c := range cases {
+		w := &Webhook{ACLURL: ts.URL, Timeout: 50 * time.Millisecond, FailOpen: c.failOpen}
+		if got := w.Authorize(&AuthInfo{ClientID: "c1", Username: c.username}, c.action, c.topic); got != c.want {
+			t.Errorf("%s %v %q (fail open %v): got %v, want %v", c.username, c.action, c.topic, c.failOpen, got, c.want)
+		}
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	var calls int32
+	ts := newWebhookServer(t, &calls)
+	defer ts.Close()
+
+	w := &Webhook{AuthURL: ts.URL, AllowTTL: time.Minute, DenyTTL: 50 * time.Millisecond}
+	authenticate := func(username string, port int) error {
+		return w.Authenticate(&AuthInfo{
+			Username: username,
+			Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		})
+	}
+
+	cases := []struct {
+		name     string
+		username string
+		port     int
+		reload   bool
+		wait     time.Duration
+		calls    int32
+	}{
+		{"allow", "allow", 1000, false, 0, 1},
+		{"allow cached", "allow", 1000, false, 0, 1},
+		{"allow other port cached", "allow", 1001, false, 0, 1},
+		{"deny", "deny", 1000, false, 0, 2},
+		{"deny cached", "deny", 1000, false, 0, 2},
+		{"deny expired", "deny", 1000, false, 100 * time.Millisecond, 3},
+		{"failure not cached", "error", 1000, false, 0, 4},
+		{"failure called again", "error", 1000, false, 0, 5},
+		{"allow reloaded", "allow", 1000, true, 0, 6},
+	}
+
+	for _, c := range cases {
+		if c.reload {
+			w.Reload()
+		}
+		time.Sleep(c.wait)
+
+		authenticate(c.username, c.port)
+		if got := atomic.LoadInt32(&calls); got != c.calls {
+			t.Errorf("%s: got %d calls, want %d", c.name, got, c.calls)
+		}
+	}
+}
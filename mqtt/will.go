@@ -0,0 +1,105 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"go.uber.org/zap"
+)
+
+// willMsg is the will message given in connect packet
+type willMsg struct {
+	pkt   *mqtt.PublishPacket
+	delay uint32 // will delay interval in seconds (mqtt 5)
+}
+
+// publish will message to subscribers as if it was sent by the client
+func (w *willMsg) publish(srv *Server, clientID string) {
+	srv.log.Debug("publish will message", zap.String("client", clientID), zap.String("topic", w.pkt.TopicName))
+
+	if w.pkt.IsRetain {
+		srv.retained.set(w.pkt)
+	}
+	srv.publish(w.pkt, clientID)
+}
+
+// setWill arms will message of the connection just lost, it is published
+// when the will delay interval passed or the session ended, whichever
+// happens first, and discarded if the session is resumed before that
+func (s *session) setWill(w *willMsg) {
+	s.mu.Lock()
+	if s.conn != nil {
+		// session already taken over by another connection
+		s.mu.Unlock()
+		if w.delay == 0 {
+			w.publish(s.srv, s.clientID)
+		}
+		return
+	}
+
+	s.stopWill()
+	if w.delay == 0 || s.ended {
+		s.mu.Unlock()
+		w.publish(s.srv, s.clientID)
+		return
+	}
+
+	s.will = w
+	s.willTimer = time.AfterFunc(time.Duration(w.delay)*time.Second, func() {
+		s.fireWill(w)
+	})
+	s.mu.Unlock()
+}
+
+// fireWill publishes the will message if it is still pending
+func (s *session) fireWill(w *willMsg) {
+	if w = s.takeWill(w); w != nil {
+		w.publish(s.srv, s.clientID)
+	}
+}
+
+// takeWill removes and returns the pending will message, w limits it to
+// the given will message, nil takes any pending one
+func (s *session) takeWill(w *willMsg) *willMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.will
+	if pending == nil || (w != nil && pending != w) {
+		return nil
+	}
+	s.stopWill()
+	return pending
+}
+
+// cancelWill discards the pending will message
+func (s *session) cancelWill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopWill()
+}
+
+func (s *session) stopWill() {
+	if s.willTimer != nil {
+		s.willTimer.Stop()
+		s.willTimer = nil
+	}
+	s.will = nil
+}
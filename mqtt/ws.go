@@ -0,0 +1,179 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// websocket sub protocol required by mqtt over websocket
+const wsSubprotocol = "mqtt"
+
+// time allowed to send close frame
+const wsCloseTimeout = time.Second
+
+var errNotBinaryFrame = errors.New("mqtt over websocket requires binary frames")
+
+func (s *Server) initWS() {
+	s.upGrader = &websocket.Upgrader{
+		ReadBufferSize:    s.opts.WSReadBuffer,
+		WriteBufferSize:   s.opts.WSWriteBuffer,
+		Subprotocols:      []string{wsSubprotocol},
+		EnableCompression: s.opts.WSCompression,
+	}
+
+	if len(s.opts.WSOrigins) > 0 {
+		s.upGrader.CheckOrigin = s.checkOrigin(s.opts.WSOrigins)
+	}
+}
+
+// checkOrigin allows requests without origin (non browser clients) and
+// requests from the listed origins, "*" allows any origin
+func (s *Server) checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+
+		s.log.Warn("ws origin not allowed", zap.String("origin", origin))
+		return false
+	}
+}
+
+// wsMux serves websocket connections at all configured paths
+func (s *Server) wsMux(l *limiter) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, path := range s.opts.WSPaths {
+		mux.HandleFunc(path, s.wsHandler(l))
+	}
+	return mux
+}
+
+// wsHandler handles websocket connections counted by the limiter
+func (s *Server) wsHandler(l *limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasSubprotocol(r, wsSubprotocol) {
+			http.Error(w, "websocket sub protocol mqtt required", http.StatusBadRequest)
+			return
+		}
+
+		if !l.acquire() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := s.upGrader.Upgrade(w, r, make(http.Header))
+		if err != nil {
+			l.release()
+			s.log.Error("establish ws connection fail", zap.Error(err))
+			return
+		}
+
+		s.handleConn(l.limit(newWSConn(conn)))
+	}
+}
+
+func hasSubprotocol(r *http.Request, protocol string) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn adapts websocket connection to net.Conn, mqtt packets are
+// carried in binary messages and may span multiple messages or frames
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader // reader of current message
+}
+
+func newWSConn(conn *websocket.Conn) net.Conn {
+	return &wsConn{Conn: conn}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			typ, r, err := c.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+
+			if typ != websocket.BinaryMessage {
+				c.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseUnsupportedData, errNotBinaryFrame.Error()),
+					time.Now().Add(wsCloseTimeout))
+				return 0, errNotBinaryFrame
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// message finished, continue with the next one
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends p as a single binary message
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Close sends close frame and closes the underlying connection
+func (c *wsConn) Close() error {
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(wsCloseTimeout))
+	return c.Conn.Close()
+}
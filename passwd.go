@@ -0,0 +1,100 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/goiiot/imq/mqtt"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func passwdCommand() cli.Command {
+	return cli.Command{
+		Name:      "passwd",
+		Usage:     "add, change or delete user of password file",
+		ArgsUsage: "<username>",
+		Description: "password is read from the first line of standard input, " +
+			"the password file is created if not exist",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "password file, password_file of config if not set",
+			},
+			cli.BoolFlag{
+				Name:  "delete, D",
+				Usage: "delete the user",
+			},
+			cli.StringFlag{
+				Name:  "hash",
+				Value: mqtt.HashPBKDF2,
+				Usage: "password hash method, one of " + mqtt.HashPBKDF2 + ", " + mqtt.HashBcrypt + " or " + mqtt.HashArgon2ID,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := passwd(c); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		},
+	}
+}
+
+func passwd(c *cli.Context) error {
+	path, username := c.String("file"), c.Args().First()
+	if path == "" {
+		path = mqtt.OptionsFromContext(c.Parent()).PasswordFile
+	}
+
+	if path == "" || username == "" || c.NArg() > 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return errors.New("password file and username required")
+	}
+
+	file, err := mqtt.LoadPasswordFile(path)
+	if os.IsNotExist(err) && !c.Bool("delete") {
+		file = mqtt.NewPasswordFile(path)
+	} else if err != nil {
+		return err
+	}
+
+	if c.Bool("delete") {
+		if !file.Remove(username) {
+			return fmt.Errorf("user %q not found", username)
+		}
+		return file.Save()
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return errors.New("password required from standard input")
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("password required from standard input")
+	}
+
+	if err := file.Set(username, []byte(password), c.String("hash")); err != nil {
+		return err
+	}
+	return file.Save()
+}
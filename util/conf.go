@@ -38,6 +38,13 @@ func BoolFlag(name string, usage string) cli.Flag {
 	})
 }
 
+func BoolTFlag(name string, usage string) cli.Flag {
+	return altsrc.NewBoolTFlag(cli.BoolTFlag{
+		Name:  name,
+		Usage: usage,
+	})
+}
+
 func IntFlag(name string, value int, usage string) cli.Flag {
 	return altsrc.NewIntFlag(cli.IntFlag{
 		Name:  name,
@@ -53,3 +60,10 @@ func DurationFlag(name string, value time.Duration, usage string) cli.Flag {
 		Usage: usage,
 	})
 }
+
+func StringSliceFlag(name string, usage string) cli.Flag {
+	return altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+		Name:  name,
+		Usage: usage,
+	})
+}